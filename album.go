@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/mymmrac/telego"
+)
+
+type album struct {
+	messages []telego.Message
+	deadline time.Time
+}
+
+type collectedAlbum struct {
+	messages  []telego.Message
+	collected time.Time
+}
+
+// Telegram delivers each item of a media group as a separate update.
+// AlbumCollector buffers these items until no new item has arrived for a short while.
+type AlbumCollector struct {
+	mu        sync.Mutex
+	wait      time.Duration
+	retention time.Duration
+	pending   map[string]*album
+	collected map[string]*collectedAlbum
+}
+
+func NewAlbumCollector(wait time.Duration, retention time.Duration) *AlbumCollector {
+	return &AlbumCollector{
+		wait:      wait,
+		retention: retention,
+		pending:   make(map[string]*album),
+		collected: make(map[string]*collectedAlbum),
+	}
+}
+
+// Collect adds the message to its media group.
+// Only the call for the first item of a media group returns, once the group is complete, with all of its items;
+// every other call returns nil immediately.
+func (c *AlbumCollector) Collect(message *telego.Message) []telego.Message {
+	c.mu.Lock()
+	if pending, ok := c.pending[message.MediaGroupID]; ok {
+		pending.messages = append(pending.messages, *message)
+		pending.deadline = time.Now().Add(c.wait)
+		c.mu.Unlock()
+		return nil
+	}
+
+	pending := &album{
+		messages: []telego.Message{*message},
+		deadline: time.Now().Add(c.wait),
+	}
+	c.pending[message.MediaGroupID] = pending
+	c.mu.Unlock()
+
+	for {
+		c.mu.Lock()
+		remaining := time.Until(pending.deadline)
+		if remaining <= 0 {
+			delete(c.pending, message.MediaGroupID)
+
+			messages := pending.messages
+			slices.SortFunc(messages, func(a, b telego.Message) int {
+				return a.MessageID - b.MessageID
+			})
+
+			c.purge()
+			c.collected[albumKey(message.Chat.ID, messages[0].MessageID)] = &collectedAlbum{
+				messages:  messages,
+				collected: time.Now(),
+			}
+			c.mu.Unlock()
+
+			return messages
+		}
+		c.mu.Unlock()
+
+		time.Sleep(remaining)
+	}
+}
+
+// Get returns a previously collected media group by the ID of its first message, if it is still retained
+func (c *AlbumCollector) Get(chatID int64, msid int) []telego.Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	collected, ok := c.collected[albumKey(chatID, msid)]
+	if !ok {
+		return nil
+	}
+
+	return collected.messages
+}
+
+// Remove collected media groups that are older than the retention period.
+// The caller must hold the lock.
+func (c *AlbumCollector) purge() {
+	for key, collected := range c.collected {
+		if time.Since(collected.collected) > c.retention {
+			delete(c.collected, key)
+		}
+	}
+}
+
+func albumKey(chatID int64, msid int) string {
+	return fmt.Sprintf("%d:%d", chatID, msid)
+}
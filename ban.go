@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+
+	database "github.com/Charibdys/tbstb/database"
+
+	"github.com/mymmrac/telego"
+)
+
+// Parse a ban duration such as "30m", "12h", "7d", or "2w"
+func parseBanDuration(text string) (time.Duration, bool) {
+	if len(text) < 2 {
+		return 0, false
+	}
+
+	count, err := strconv.Atoi(text[:len(text)-1])
+	if err != nil || count <= 0 {
+		return 0, false
+	}
+
+	var unit time.Duration
+	switch text[len(text)-1] {
+	case 'm':
+		unit = time.Minute
+	case 'h':
+		unit = time.Hour
+	case 'd':
+		unit = 24 * time.Hour
+	case 'w':
+		unit = 7 * 24 * time.Hour
+	default:
+		return 0, false
+	}
+
+	return time.Duration(count) * unit, true
+}
+
+// Describe a user to staff without revealing the name of anonymous users
+func describeUser(user *database.User) string {
+	if user.Onymity {
+		return "The user"
+	}
+
+	return html.EscapeString(user.Fullname)
+}
+
+func formatBanNotice(user *database.User) string {
+	text := "You have been banned from contacting staff"
+	if user.BannedUntil != nil {
+		text += fmt.Sprintf(" until %s", user.BannedUntil.Local().Format("2006-01-02 15:04 MST"))
+	}
+	text += "."
+
+	if user.BanReason != "" {
+		text += fmt.Sprintf("\n\n<b>Reason:</b> %s", html.EscapeString(user.BanReason))
+	}
+
+	return text
+}
+
+// Check whether the user is banned, lifting the ban if it has run out
+func checkBanned(db *database.Connection, user *database.User) bool {
+	if !user.Banned {
+		return false
+	}
+
+	if !user.IsBanned() {
+		user.Banned = false
+		user.BannedUntil = nil
+		user.BanReason = ""
+		db.UpdateUser(user)
+		return false
+	}
+
+	return true
+}
+
+// Reply to a message from a banned user with the ban notice.
+// Returns true if the user is banned, in which case the message should not be handled any further.
+func refuseBanned(bot *TBSTBBot, db *database.Connection, user *database.User, message *telego.Message) bool {
+	if !checkBanned(db, user) {
+		return false
+	}
+
+	_, _ = bot.SendMessage(&telego.SendMessageParams{
+		ChatID:          telego.ChatID{ID: message.Chat.ID},
+		Text:            formatBanNotice(user),
+		ReplyParameters: &telego.ReplyParameters{MessageID: message.MessageID},
+		ParseMode:       "HTML",
+	})
+
+	return true
+}
+
+// Answer a button pressed by a banned user, such as on a keyboard sent before the ban.
+// Returns true if the user is banned, in which case the query should not be handled any further.
+func refuseBannedQuery(bot *TBSTBBot, db *database.Connection, user *database.User, query *telego.CallbackQuery) bool {
+	if !checkBanned(db, user) {
+		return false
+	}
+
+	bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+		CallbackQueryID: query.ID,
+		Text:            "You have been banned from contacting staff.",
+		ShowAlert:       true,
+	})
+
+	return true
+}
+
+func banCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection) {
+	_, allowed := authorize(db, update.Message.From.ID, database.PermissionBan)
+	if !allowed {
+		return
+	}
+
+	target, args, reason := resolveTarget(bot, update.Message, strings.Fields(update.Message.Text)[1:], db)
+
+	var text string
+	if target == nil {
+		text = reason
+	} else if role, _ := db.GetRole(target.ID); role != nil {
+		text = "Staff members cannot be banned. Use /demote first."
+	} else {
+		target.Banned = true
+		target.BannedUntil = nil
+
+		if len(args) > 0 {
+			if duration, ok := parseBanDuration(args[0]); ok {
+				until := time.Now().Add(duration)
+				target.BannedUntil = &until
+				args = args[1:]
+			}
+		}
+		target.BanReason = strings.Join(args, " ")
+
+		db.UpdateUser(target)
+
+		text = fmt.Sprintf("%s has been banned", describeUser(target))
+		if target.BannedUntil != nil {
+			text += fmt.Sprintf(" until %s", target.BannedUntil.Local().Format("2006-01-02 15:04 MST"))
+		}
+		text += "."
+
+		_, _ = bot.SendMessage(&telego.SendMessageParams{
+			ChatID:    telego.ChatID{ID: target.ID},
+			Text:      formatBanNotice(target),
+			ParseMode: "HTML",
+		})
+	}
+
+	_, _ = bot.SendMessage(&telego.SendMessageParams{
+		ChatID:          telego.ChatID{ID: update.Message.Chat.ID},
+		Text:            text,
+		ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+		ParseMode:       "HTML",
+	})
+}
+
+func unbanCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection) {
+	_, allowed := authorize(db, update.Message.From.ID, database.PermissionBan)
+	if !allowed {
+		return
+	}
+
+	target, _, reason := resolveTarget(bot, update.Message, strings.Fields(update.Message.Text)[1:], db)
+
+	var text string
+	if target == nil {
+		text = reason
+	} else if !checkBanned(db, target) {
+		text = fmt.Sprintf("%s is not banned.", describeUser(target))
+	} else {
+		target.Banned = false
+		target.BannedUntil = nil
+		target.BanReason = ""
+
+		db.UpdateUser(target)
+
+		text = fmt.Sprintf("%s has been unbanned.", describeUser(target))
+
+		_, _ = bot.SendMessage(&telego.SendMessageParams{
+			ChatID:    telego.ChatID{ID: target.ID},
+			Text:      "You have been unbanned, and can contact staff again.",
+			ParseMode: "HTML",
+		})
+	}
+
+	_, _ = bot.SendMessage(&telego.SendMessageParams{
+		ChatID:          telego.ChatID{ID: update.Message.Chat.ID},
+		Text:            text,
+		ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+		ParseMode:       "HTML",
+	})
+}
+
+// Grant or revoke a user's ability to reopen their own tickets
+func reopenRightsCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection) {
+	_, allowed := authorize(db, update.Message.From.ID, database.PermissionReopen)
+	if !allowed {
+		return
+	}
+
+	target, args, reason := resolveTarget(bot, update.Message, strings.Fields(update.Message.Text)[1:], db)
+
+	config, err := db.GetConfig()
+	if err != nil {
+		return
+	}
+
+	var text string
+	switch {
+	case target == nil:
+		text = reason
+	case len(args) == 0:
+		if target.MayReopen(config) {
+			text = fmt.Sprintf("%s can reopen their tickets", describeUser(target))
+		} else {
+			text = fmt.Sprintf("%s cannot reopen their tickets", describeUser(target))
+		}
+		if !target.ReopenOverride {
+			text += ", as is the default"
+		}
+		text += ".\n\nUse <code>/reopen_rights on</code> or <code>/reopen_rights off</code> to change this, " +
+			"or <code>/reopen_rights default</code> to follow the default."
+	case args[0] == "on" || args[0] == "off":
+		target.CanReopen = args[0] == "on"
+		target.ReopenOverride = true
+		db.UpdateUser(target)
+
+		if target.CanReopen {
+			text = fmt.Sprintf("%s can now reopen their tickets.", describeUser(target))
+		} else {
+			text = fmt.Sprintf("%s can no longer reopen their tickets.", describeUser(target))
+		}
+	case args[0] == "default":
+		target.CanReopen = config.UserReopen
+		target.ReopenOverride = false
+		db.UpdateUser(target)
+
+		if config.UserReopen {
+			text = fmt.Sprintf("%s now follows the default, and can reopen their tickets.", describeUser(target))
+		} else {
+			text = fmt.Sprintf("%s now follows the default, and cannot reopen their tickets.", describeUser(target))
+		}
+	default:
+		text = "Please use <code>on</code>, <code>off</code>, or <code>default</code>."
+	}
+
+	_, _ = bot.SendMessage(&telego.SendMessageParams{
+		ChatID:          telego.ChatID{ID: update.Message.Chat.ID},
+		Text:            text,
+		ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+		ParseMode:       "HTML",
+	})
+}
@@ -0,0 +1,887 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	database "github.com/Charibdys/tbstb/database"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+// Broadcasts are not sent right away; the owner first sees a preview of the draft and confirms it
+func broadcastCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection) {
+	role, allowed := authorize(db, update.Message.From.ID, database.PermissionBroadcast)
+	if role == nil {
+		noUser(bot, update.Message)
+		return
+	}
+	if !allowed {
+		return
+	}
+
+	chatID := broadcastChat(update.Message, role)
+
+	params, schedule, segment, reason := parseBroadcast(update.Message, time.Now())
+	if reason != "" {
+		_, _ = bot.SendMessage(&telego.SendMessageParams{
+			ChatID:          telego.ChatID{ID: chatID},
+			Text:            reason,
+			ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+			ParseMode:       "HTML",
+		})
+
+		return
+	}
+
+	encoded, err := encodeRelay(params, 0)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return
+	}
+
+	broadcast := db.CreateBroadcast(role.ID, chatID, update.Message.MessageID, encoded)
+	broadcast.Schedule = schedule
+	broadcast.Segment = segment
+
+	showBroadcastPreview(bot, db, broadcast, params)
+}
+
+// Update the draft and its preview when the owner edits the broadcast command.
+// Returns true if the edited message was a broadcast command.
+func broadcastEdited(bot *TBSTBBot, message *telego.Message, db *database.Connection) bool {
+	text := message.Text
+	if text == "" {
+		text = message.Caption
+	}
+	if !strings.HasPrefix(text, "/broadcast") {
+		return false
+	}
+
+	broadcast, err := db.GetBroadcastFromOrigin(message.Chat.ID, message.MessageID)
+	if err != nil {
+		return false
+	}
+
+	if broadcast.Status != "draft" {
+		_, _ = bot.SendMessage(&telego.SendMessageParams{
+			ChatID:          telego.ChatID{ID: broadcast.ChatID},
+			Text:            fmt.Sprintf("This broadcast has already been %s and cannot be changed.", broadcast.Status),
+			ReplyParameters: &telego.ReplyParameters{MessageID: message.MessageID},
+			ParseMode:       "HTML",
+		})
+		return true
+	}
+
+	params, schedule, segment, reason := parseBroadcast(message, time.Now())
+	if reason != "" {
+		_, _ = bot.SendMessage(&telego.SendMessageParams{
+			ChatID:          telego.ChatID{ID: broadcast.ChatID},
+			Text:            reason,
+			ReplyParameters: &telego.ReplyParameters{MessageID: message.MessageID},
+			ParseMode:       "HTML",
+		})
+		return true
+	}
+
+	encoded, err := encodeRelay(params, 0)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return true
+	}
+	broadcast.Params = encoded
+	broadcast.Schedule = schedule
+	broadcast.Segment = segment
+
+	for _, msid := range append(broadcast.Preview, broadcast.ControlMSID) {
+		_ = bot.DeleteMessage(&telego.DeleteMessageParams{
+			ChatID:    telego.ChatID{ID: broadcast.ChatID},
+			MessageID: msid,
+		})
+	}
+
+	showBroadcastPreview(bot, db, broadcast, params)
+
+	return true
+}
+
+// Broadcasts written in a group are previewed there; otherwise they are previewed in the owner's private chat
+func broadcastChat(message *telego.Message, role *database.Role) int64 {
+	if message.Chat.Type == "group" || message.Chat.Type == "supergroup" {
+		return message.Chat.ID
+	}
+
+	return role.ID
+}
+
+// Get the parameters for relaying a broadcast command, its schedule and segment if it has them,
+// or the reason it cannot be sent
+func parseBroadcast(message *telego.Message, now time.Time) (*RelayParams, *database.Schedule, *database.Segment, string) {
+	var text string
+	if message.Caption == "" {
+		text = message.Text
+	} else {
+		text = message.Caption
+	}
+
+	arg := strings.SplitN(text, " ", 2)
+	if len(arg) != 2 {
+		if message.Caption == "" {
+			return nil, nil, nil, "The broadcast command requires input."
+		}
+		text = ""
+	} else {
+		text = arg[1]
+	}
+
+	if strings.TrimSpace(text) != text {
+		return nil, nil, nil, "Please remove any whitespaces between the command and the text."
+	}
+
+	segment, consumed, reason := parseSegment(text, now)
+	if reason != "" {
+		return nil, nil, nil, reason
+	}
+
+	schedule, scheduleLength, reason := parseSchedule(text[consumed:], now)
+	if reason != "" {
+		return nil, nil, nil, reason
+	}
+	consumed += scheduleLength
+	text = text[consumed:]
+
+	media, _ := getMessageMediaID(message)
+	if text == "" && media == nil {
+		return nil, nil, nil, "The broadcast command requires input."
+	}
+
+	var entities []telego.MessageEntity
+	if len(message.Entities) > 1 {
+		entities = message.Entities
+	} else if len(message.CaptionEntities) > 1 {
+		entities = message.CaptionEntities
+	}
+
+	// Shift the entities past the command, segment, and schedule, dropping any that were within them.
+	// Without a space after the command, nothing of the text is relayed, so no entities apply to it.
+	var updatedEntities []telego.MessageEntity
+	if entities != nil && len(arg) == 2 {
+		offset := entities[0].Length + 1 + len(utf16.Encode([]rune(arg[1][:consumed])))
+		for _, entity := range entities[1:] {
+			entity.Offset -= offset
+			if entity.Offset < 0 {
+				continue
+			}
+			updatedEntities = append(updatedEntities, entity)
+		}
+	}
+
+	fmtText, continuation := formatRelayText(&telego.Message{Text: text, Entities: updatedEntities}, "", media != nil)
+
+	return &RelayParams{
+		Text:         fmtText,
+		Media:        media,
+		ParseMode:    "HTML",
+		Message:      message,
+		Continuation: continuation,
+	}, schedule, segment, ""
+}
+
+// Parse a segment at the start of a broadcast, in the form "to open", "to active:DAYS", "to joined:YYYY-MM-DD",
+// "to category:NAME", or "to staff".
+// Returns the segment, or nil if the text does not start with one, and the length of the text it took up.
+func parseSegment(text string, now time.Time) (*database.Segment, int, string) {
+	fields := strings.SplitN(text, " ", 3)
+	if len(fields) < 2 || fields[0] != "to" {
+		return nil, 0, ""
+	}
+
+	var segment *database.Segment
+	kind, value, _ := strings.Cut(fields[1], ":")
+	switch kind {
+	case "open", "staff":
+		if value != "" {
+			return nil, 0, ""
+		}
+		segment = &database.Segment{Type: kind}
+	case "active":
+		days, err := strconv.Atoi(value)
+		if err != nil || days < 1 {
+			return nil, 0, "Please give the number of days as a positive whole number, as in <code>to active:30</code>."
+		}
+		segment = &database.Segment{Type: kind, Days: days}
+	case "joined":
+		date, err := time.ParseInLocation("2006-01-02", value, time.Local)
+		if err != nil {
+			return nil, 0, "Please give the date as YYYY-MM-DD, as in <code>to joined:2024-01-31</code>."
+		}
+		if date.After(now) {
+			return nil, 0, "The join date must be in the past."
+		}
+		segment = &database.Segment{Type: kind, Date: &date}
+	case "category":
+		if value == "" {
+			return nil, 0, "Please give the name of the category, as in <code>to category:billing</code>."
+		}
+		segment = &database.Segment{Type: kind, Category: strings.ToLower(value)}
+	default:
+		// Not a segment, just a broadcast that starts with "to"
+		return nil, 0, ""
+	}
+
+	consumed := min(len(fields[0])+len(fields[1])+2, len(text))
+
+	return segment, consumed, ""
+}
+
+// Describe the users in a segment
+func formatSegment(segment *database.Segment) string {
+	if segment == nil {
+		return "all users"
+	}
+
+	switch segment.Type {
+	case "open":
+		return "users with open tickets"
+	case "active":
+		return fmt.Sprintf("users active in the last %d days", segment.Days)
+	case "joined":
+		return fmt.Sprintf("users who joined after %s (users without a recorded join date are not included)",
+			segment.Date.Local().Format("2006-01-02"))
+	case "category":
+		return fmt.Sprintf("creators of tickets in the <b>%s</b> category", html.EscapeString(segment.Category))
+	case "staff":
+		return "staff"
+	}
+
+	return segment.Type
+}
+
+// Parse a schedule at the start of a broadcast, in the form "at [YYYY-MM-DD] HH:MM [daily|weekly]".
+// Times are in the server's time zone; a time without a date is its next occurrence.
+// Returns the schedule, or nil if the text does not start with one, and the length of the text it took up.
+func parseSchedule(text string, now time.Time) (*database.Schedule, int, string) {
+	fields := strings.SplitN(text, " ", 5)
+	if len(fields) < 2 || fields[0] != "at" {
+		return nil, 0, ""
+	}
+
+	i := 1
+	var date string
+	if _, err := time.Parse("2006-01-02", fields[i]); err == nil {
+		date = fields[i]
+		i++
+	}
+
+	if i >= len(fields) {
+		return nil, 0, ""
+	}
+	clock, err := time.ParseInLocation("15:04", fields[i], time.Local)
+	if err != nil {
+		if date != "" {
+			return nil, 0, "Please give the time of a scheduled broadcast as HH:MM."
+		}
+		// Not a schedule, just a broadcast that starts with "at"
+		return nil, 0, ""
+	}
+	i++
+
+	var at time.Time
+	if date != "" {
+		at, _ = time.ParseInLocation("2006-01-02 15:04", date+" "+clock.Format("15:04"), time.Local)
+	} else {
+		at = time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, time.Local)
+		if !at.After(now) {
+			at = at.AddDate(0, 0, 1)
+		}
+	}
+
+	if !at.After(now) {
+		return nil, 0, "The time of a scheduled broadcast must be in the future."
+	}
+
+	var repeat string
+	if i < len(fields) && (fields[i] == "daily" || fields[i] == "weekly") {
+		repeat = fields[i]
+		i++
+	}
+
+	consumed := min(len(strings.Join(fields[:i], " "))+1, len(text))
+
+	return &database.Schedule{At: at, Repeat: repeat}, consumed, ""
+}
+
+// Get the next time a repeating schedule runs after the given time
+func nextRun(run time.Time, repeat string, after time.Time) time.Time {
+	days := 1
+	if repeat == "weekly" {
+		days = 7
+	}
+
+	// Repeat at the same local time across daylight saving changes
+	run = run.Local()
+	for !run.After(after) {
+		run = run.AddDate(0, 0, days)
+	}
+
+	return run
+}
+
+func formatSchedule(schedule *database.Schedule) string {
+	text := schedule.At.Local().Format("2006-01-02 15:04 MST")
+	if schedule.Repeat != "" {
+		text += fmt.Sprintf(", repeating %s", schedule.Repeat)
+	}
+
+	return text
+}
+
+// Show the broadcast as users will receive it, followed by buttons to send or cancel it
+func showBroadcastPreview(bot *TBSTBBot, db *database.Connection, broadcast *database.Broadcast, params *RelayParams) {
+	msgs, err := relay(broadcast.ChatID, params, bot)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+	}
+
+	broadcast.Preview = nil
+	for _, msg := range msgs {
+		broadcast.Preview = append(broadcast.Preview, msg.MessageID)
+	}
+
+	var count int
+	users := db.GetSegmentUsers(broadcast.Segment, &broadcast.ChatID)
+	if users != nil {
+		count = len(*users)
+	}
+
+	id := broadcast.ID.Hex()
+
+	text := fmt.Sprintf("<b>Broadcast preview</b>\n\nThis broadcast will be sent to %d users (%s).\n",
+		count, formatSegment(broadcast.Segment))
+	button := "Send"
+	if broadcast.Schedule != nil {
+		text = fmt.Sprintf("<b>Broadcast preview</b>\n\nThis broadcast will be sent at %s to %d users (%s).\n",
+			formatSchedule(broadcast.Schedule), count, formatSegment(broadcast.Segment))
+		button = "Schedule"
+	}
+	text += "Edit your /broadcast message to change it before sending."
+
+	control, err := bot.SendMessage(&telego.SendMessageParams{
+		ChatID:          telego.ChatID{ID: broadcast.ChatID},
+		Text:            text,
+		ReplyParameters: &telego.ReplyParameters{MessageID: broadcast.OriginMSID},
+		ReplyMarkup: tu.InlineKeyboard(
+			tu.InlineKeyboardRow(
+				tu.InlineKeyboardButton(button).WithCallbackData(fmt.Sprintf("broadcast_send=%s", id)),
+				tu.InlineKeyboardButton("Cancel").WithCallbackData(fmt.Sprintf("broadcast_cancel=%s", id)),
+			),
+		),
+		ParseMode: "HTML",
+	})
+	if err != nil {
+		fmt.Printf("%s\n", err)
+	} else {
+		broadcast.ControlMSID = control.MessageID
+	}
+
+	db.UpdateBroadcast(broadcast)
+}
+
+// Get a broadcast from a callback query, answering the query if it cannot be used
+func queryBroadcast(bot *TBSTBBot, query *telego.CallbackQuery, db *database.Connection) *database.Broadcast {
+	if _, allowed := authorize(db, query.From.ID, database.PermissionBroadcast); !allowed {
+		bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+			CallbackQueryID: query.ID,
+			Text:            "You are not allowed to send broadcasts.",
+			ShowAlert:       true,
+		})
+		return nil
+	}
+
+	broadcast, err := db.GetBroadcast(strings.Split(query.Data, "=")[1])
+	if err != nil {
+		bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+			CallbackQueryID: query.ID,
+			Text:            "This broadcast does not exist.",
+			ShowAlert:       true,
+		})
+		return nil
+	}
+
+	return broadcast
+}
+
+func sendBroadcast(bot *TBSTBBot, query *telego.CallbackQuery, db *database.Connection) {
+	broadcast := queryBroadcast(bot, query, db)
+	if broadcast == nil {
+		return
+	}
+
+	status := "sent"
+	if broadcast.Schedule != nil {
+		status = "scheduled"
+	}
+
+	if !db.UpdateBroadcastStatus(broadcast.ID, "draft", status) {
+		bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+			CallbackQueryID: query.ID,
+			Text:            "This broadcast has already been sent or canceled.",
+			ShowAlert:       true,
+		})
+		return
+	}
+
+	if broadcast.Schedule != nil {
+		db.CreateJob(broadcast.ID, query.From.ID, broadcast.Schedule.At, broadcast.Schedule.Repeat)
+
+		bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+			CallbackQueryID: query.ID,
+			Text:            "Scheduled broadcast",
+		})
+
+		bot.EditMessageText(&telego.EditMessageTextParams{
+			ChatID:    telego.ChatID{ID: broadcast.ChatID},
+			MessageID: broadcast.ControlMSID,
+			Text: fmt.Sprintf("Scheduled broadcast for %s.\nUse /scheduled to see or cancel scheduled broadcasts.",
+				formatSchedule(broadcast.Schedule)),
+		})
+		return
+	}
+
+	bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+		CallbackQueryID: query.ID,
+		Text:            "Sending broadcast",
+	})
+
+	bot.EditMessageText(&telego.EditMessageTextParams{
+		ChatID:    telego.ChatID{ID: broadcast.ChatID},
+		MessageID: broadcast.ControlMSID,
+		Text:      "Sending broadcast...",
+	})
+
+	reached := deliverBroadcast(bot, db, broadcast)
+
+	id := broadcast.ID.Hex()
+
+	bot.EditMessageText(&telego.EditMessageTextParams{
+		ChatID:    telego.ChatID{ID: broadcast.ChatID},
+		MessageID: broadcast.ControlMSID,
+		Text: fmt.Sprintf("Success! Sent broadcast <code>%s</code> to %d users.\n"+
+			"Use /broadcast_status to see its delivery report.", id[len(id)-7:], reached),
+		ParseMode: "HTML",
+	})
+}
+
+// Send a broadcast to the users in its segment who receive broadcasts, and return how many users it reached.
+// The copies that are delivered, and the users it could not be delivered to, are stored with the broadcast.
+func deliverBroadcast(bot *TBSTBBot, db *database.Connection, broadcast *database.Broadcast) int {
+	params, _, err := decodeRelay(broadcast.Params)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return 0
+	}
+
+	users := db.GetSegmentUsers(broadcast.Segment, &broadcast.ChatID)
+	if users == nil {
+		return 0
+	}
+	params.BroadcastID = broadcast.ID.Hex()
+
+	db.SetBroadcastRecipients(broadcast.ID, len(*users))
+
+	bulk := bot.Bulk()
+
+	// Long broadcasts are split into several messages per user
+	reached := make(map[int64]bool)
+	for _, userID := range *users {
+		params.Users = []int64{userID}
+
+		confirmedReceivers := sendMessage(params, bulk)
+		db.AppendBroadcastReceivers(params.BroadcastID, confirmedReceivers)
+
+		// The broadcast is retracted before its copies are deleted, so copies stored after that are deleted here
+		if db.GetBroadcastStatus(params.BroadcastID) == "retracted" {
+			deleteCopies(bot, confirmedReceivers)
+			break
+		}
+
+		for _, receiver := range confirmedReceivers {
+			reached[receiver.UserID] = true
+		}
+	}
+
+	return len(reached)
+}
+
+func cancelBroadcast(bot *TBSTBBot, query *telego.CallbackQuery, db *database.Connection) {
+	broadcast := queryBroadcast(bot, query, db)
+	if broadcast == nil {
+		return
+	}
+
+	if !db.UpdateBroadcastStatus(broadcast.ID, "draft", "canceled") {
+		bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+			CallbackQueryID: query.ID,
+			Text:            "This broadcast has already been sent or canceled.",
+			ShowAlert:       true,
+		})
+		return
+	}
+
+	bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+		CallbackQueryID: query.ID,
+		Text:            "Canceled broadcast",
+	})
+
+	bot.EditMessageText(&telego.EditMessageTextParams{
+		ChatID:    telego.ChatID{ID: broadcast.ChatID},
+		MessageID: broadcast.ControlMSID,
+		Text:      "Broadcast canceled.",
+	})
+}
+
+// List pending scheduled broadcasts with buttons to cancel them
+func scheduledCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection) {
+	role, allowed := authorize(db, update.Message.From.ID, database.PermissionBroadcast)
+	if role == nil {
+		noUser(bot, update.Message)
+		return
+	}
+	if !allowed {
+		return
+	}
+
+	chatID := broadcastChat(update.Message, role)
+
+	jobs := db.GetPendingJobs()
+	if len(jobs) == 0 {
+		_, _ = bot.SendMessage(&telego.SendMessageParams{
+			ChatID:          telego.ChatID{ID: chatID},
+			Text:            "There are no scheduled broadcasts.",
+			ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+			ParseMode:       "HTML",
+		})
+		return
+	}
+
+	text := "<b>Scheduled broadcasts</b>\n\n"
+	var rows [][]telego.InlineKeyboardButton
+	for i, job := range jobs {
+		text += formatJobEntry(i+1, &job, db)
+		rows = append(rows, tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(fmt.Sprintf("Cancel %d", i+1)).WithCallbackData(fmt.Sprintf("cancel_job=%s", job.ID.Hex())),
+		))
+	}
+
+	_, _ = bot.SendMessage(&telego.SendMessageParams{
+		ChatID:          telego.ChatID{ID: chatID},
+		Text:            text,
+		ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+		ReplyMarkup:     tu.InlineKeyboard(rows...),
+		ParseMode:       "HTML",
+	})
+}
+
+func formatJobEntry(index int, job *database.Job, db *database.Connection) string {
+	schedule := &database.Schedule{At: job.NextRun, Repeat: job.Repeat}
+
+	var preview string
+	var segment *database.Segment
+	broadcast, err := db.GetBroadcast(job.BroadcastID.Hex())
+	if err == nil {
+		segment = broadcast.Segment
+		if params, _, err := decodeRelay(broadcast.Params); err == nil {
+			preview = database.MakeTitle(html.UnescapeString(tagPattern.ReplaceAllString(params.Text, "")))
+		}
+	}
+	if preview == "" {
+		preview = "<i>No text</i>"
+	} else {
+		preview = html.EscapeString(preview)
+	}
+
+	return fmt.Sprintf("<b>%d.</b> %s, to %s\n%s\n\n", index, formatSchedule(schedule), formatSegment(segment), preview)
+}
+
+func cancelJob(bot *TBSTBBot, query *telego.CallbackQuery, db *database.Connection) {
+	if _, allowed := authorize(db, query.From.ID, database.PermissionBroadcast); !allowed {
+		bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+			CallbackQueryID: query.ID,
+			Text:            "You are not allowed to cancel scheduled broadcasts.",
+			ShowAlert:       true,
+		})
+		return
+	}
+
+	job, err := db.GetJob(strings.Split(query.Data, "=")[1])
+	if err != nil || !db.CancelJob(job.ID) {
+		bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+			CallbackQueryID: query.ID,
+			Text:            "This scheduled broadcast has already been sent or canceled.",
+			ShowAlert:       true,
+		})
+		return
+	}
+
+	db.UpdateBroadcastStatus(job.BroadcastID, "scheduled", "canceled")
+
+	bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+		CallbackQueryID: query.ID,
+		Text:            fmt.Sprintf("Canceled the broadcast scheduled for %s", job.NextRun.Local().Format("2006-01-02 15:04 MST")),
+	})
+}
+
+// Show recent broadcasts, or the delivery report of one broadcast given its ID
+func broadcastStatusCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection) {
+	role, allowed := authorize(db, update.Message.From.ID, database.PermissionBroadcast)
+	if role == nil {
+		noUser(bot, update.Message)
+		return
+	}
+	if !allowed {
+		return
+	}
+
+	chatID := broadcastChat(update.Message, role)
+
+	var text string
+	arg := strings.Fields(update.Message.Text)
+	if len(arg) < 2 {
+		broadcasts := db.GetSentBroadcasts(10)
+		if len(broadcasts) == 0 {
+			text = "No broadcasts have been sent."
+		} else {
+			text = "<b>Recent broadcasts</b>\n\n"
+			for i, broadcast := range broadcasts {
+				text += formatBroadcastEntry(i+1, &broadcast)
+			}
+			text += "\nUse <code>/broadcast_status ID</code> to see the delivery report of a broadcast."
+		}
+	} else {
+		broadcast := findSentBroadcast(db, arg[1])
+		if broadcast == nil {
+			text = "This broadcast does not exist."
+		} else {
+			text = formatBroadcastReport(broadcast, db.CountPendingOutboxItems(broadcast.ID.Hex()))
+		}
+	}
+
+	_, _ = bot.SendMessage(&telego.SendMessageParams{
+		ChatID:          telego.ChatID{ID: chatID},
+		Text:            text,
+		ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+		ParseMode:       "HTML",
+	})
+}
+
+// Delete every delivered copy of a broadcast
+func broadcastDeleteCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection) {
+	role, allowed := authorize(db, update.Message.From.ID, database.PermissionBroadcast)
+	if role == nil {
+		noUser(bot, update.Message)
+		return
+	}
+	if !allowed {
+		return
+	}
+
+	chatID := broadcastChat(update.Message, role)
+
+	var text string
+	arg := strings.Fields(update.Message.Text)
+	if len(arg) < 2 {
+		text = "Please give the ID of the broadcast to delete, as shown by /broadcast_status."
+	} else if broadcast := findSentBroadcast(db, arg[1]); broadcast == nil {
+		text = "This broadcast does not exist."
+	} else if broadcast.Status == "retracted" {
+		text = "This broadcast has already been deleted."
+	} else {
+		// Copies still waiting to be retried would otherwise be delivered after the deletion
+		db.DeletePendingOutboxItems(broadcast.ID.Hex())
+
+		// Retract the broadcast first, so a delivery still in progress stops and deletes the copies it sends from now on
+		db.RetractBroadcast(broadcast.ID)
+		if current, err := db.GetBroadcast(broadcast.ID.Hex()); err == nil {
+			broadcast = current
+		}
+
+		deleted := deleteCopies(bot, broadcast.Receivers)
+
+		text = fmt.Sprintf("Deleted the broadcast for %d of %d users.", deleted, countReceivers(broadcast.Receivers))
+		if deleted < countReceivers(broadcast.Receivers) {
+			text += "\nTelegram does not allow bots to delete messages that are more than 48 hours old."
+		}
+	}
+
+	_, _ = bot.SendMessage(&telego.SendMessageParams{
+		ChatID:          telego.ChatID{ID: chatID},
+		Text:            text,
+		ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+		ParseMode:       "HTML",
+	})
+}
+
+// Replace the text or caption of every delivered copy of a broadcast
+func broadcastEditCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection) {
+	role, allowed := authorize(db, update.Message.From.ID, database.PermissionBroadcast)
+	if role == nil {
+		noUser(bot, update.Message)
+		return
+	}
+	if !allowed {
+		return
+	}
+
+	chatID := broadcastChat(update.Message, role)
+
+	var text string
+	arg := strings.SplitN(update.Message.Text, " ", 3)
+	if len(arg) < 3 || strings.TrimSpace(arg[2]) == "" {
+		text = "Please give the ID of the broadcast to edit, as shown by /broadcast_status, followed by the new text."
+	} else if broadcast := findSentBroadcast(db, arg[1]); broadcast == nil {
+		text = "This broadcast does not exist."
+	} else if broadcast.Status == "retracted" {
+		text = "This broadcast has been deleted and cannot be edited."
+	} else if params, _, err := decodeRelay(broadcast.Params); err != nil {
+		fmt.Printf("%s\n", err)
+		return
+	} else {
+		// Shift the entities past the command and the ID
+		var entities []telego.MessageEntity
+		offset := len(utf16.Encode([]rune(arg[0] + " " + arg[1] + " ")))
+		for _, entity := range update.Message.Entities {
+			entity.Offset -= offset
+			if entity.Offset >= 0 {
+				entities = append(entities, entity)
+			}
+		}
+
+		fmtText, continuation := formatRelayText(&telego.Message{Text: arg[2], Entities: entities}, "", params.Media != nil)
+
+		// Copies can only be edited, so the new text must fit in as many messages as were sent
+		if len(continuation) > len(params.Continuation) {
+			text = "The new text is too long to fit in the messages that were sent."
+		} else {
+			parts := append([]string{fmtText}, continuation...)
+			edited, _ := editCopies(bot, broadcast.Receivers, parts, params.Media != nil, 1)
+
+			params.Text = fmtText
+			params.Continuation = continuation
+			if encoded, err := encodeRelay(params, 0); err == nil {
+				db.EditBroadcast(broadcast.ID, encoded)
+			}
+
+			text = fmt.Sprintf("Edited the broadcast for %d of %d users.", edited, countReceivers(broadcast.Receivers))
+		}
+	}
+
+	_, _ = bot.SendMessage(&telego.SendMessageParams{
+		ChatID:          telego.ChatID{ID: chatID},
+		Text:            text,
+		ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+		ParseMode:       "HTML",
+	})
+}
+
+// Find a broadcast that has been sent by the last characters of its ID
+func findSentBroadcast(db *database.Connection, shortID string) *database.Broadcast {
+	if len(shortID) < 7 {
+		return nil
+	}
+
+	broadcast, err := db.GetSentBroadcast(shortID)
+	if err != nil {
+		return nil
+	}
+
+	return broadcast
+}
+
+// Delete the delivered copies of a broadcast, and return the number of users whose copy was deleted
+func deleteCopies(bot *TBSTBBot, receivers []database.Receiver) int {
+	deleted := make(map[int64]bool)
+	for _, receiver := range receivers {
+		err := bot.DeleteMessage(&telego.DeleteMessageParams{
+			ChatID:    telego.ChatID{ID: receiver.UserID},
+			MessageID: receiver.MSID,
+		})
+		if err != nil {
+			fmt.Printf("%s\n", err)
+			continue
+		}
+		deleted[receiver.UserID] = true
+	}
+
+	return len(deleted)
+}
+
+// Count the users who received a copy of a broadcast
+func countReceivers(receivers []database.Receiver) int {
+	users := make(map[int64]bool)
+	for _, receiver := range receivers {
+		users[receiver.UserID] = true
+	}
+
+	return len(users)
+}
+
+func formatBroadcastEntry(index int, broadcast *database.Broadcast) string {
+	id := broadcast.ID.Hex()
+
+	var sent string
+	if broadcast.DateSent != nil {
+		sent = broadcast.DateSent.Local().Format("2006-01-02 15:04")
+	}
+
+	entry := fmt.Sprintf("<b>%d.</b> <code>%s</code> %s, delivered to %d of %d users",
+		index, id[len(id)-7:], sent, countReceivers(broadcast.Receivers), broadcast.Recipients)
+	if broadcast.Status == "retracted" {
+		entry += ", <i>deleted</i>"
+	}
+
+	return entry + "\n"
+}
+
+func formatBroadcastReport(broadcast *database.Broadcast, pending int64) string {
+	id := broadcast.ID.Hex()
+
+	text := fmt.Sprintf("<b>Broadcast</b> <code>%s</code>\n\n", id[len(id)-7:])
+	if broadcast.DateSent != nil {
+		text += fmt.Sprintf("<b>Sent:</b> %s\n", broadcast.DateSent.Local().Format("2006-01-02 15:04 MST"))
+	}
+	if broadcast.DateEdited != nil {
+		text += fmt.Sprintf("<b>Edited:</b> %s\n", broadcast.DateEdited.Local().Format("2006-01-02 15:04 MST"))
+	}
+	if broadcast.DateRetracted != nil {
+		text += fmt.Sprintf("<b>Deleted:</b> %s\n", broadcast.DateRetracted.Local().Format("2006-01-02 15:04 MST"))
+	}
+
+	text += fmt.Sprintf("<b>Audience:</b> %s\n", formatSegment(broadcast.Segment))
+	text += fmt.Sprintf("<b>Recipients:</b> %d\n<b>Delivered:</b> %d\n<b>Waiting to retry:</b> %d\n<b>Failed:</b> %d\n",
+		broadcast.Recipients, countReceivers(broadcast.Receivers), pending, len(broadcast.Failures))
+
+	// Group failures by reason, most common first
+	reasons := make(map[string]int)
+	var order []string
+	for _, failure := range broadcast.Failures {
+		if reasons[failure.Reason] == 0 {
+			order = append(order, failure.Reason)
+		}
+		reasons[failure.Reason]++
+	}
+	slices.SortStableFunc(order, func(a, b string) int {
+		return reasons[b] - reasons[a]
+	})
+
+	for _, reason := range order {
+		text += fmt.Sprintf("  • %s: %d\n", html.EscapeString(reason), reasons[reason])
+	}
+
+	return text
+}
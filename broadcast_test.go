@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mymmrac/telego"
+)
+
+func TestParseBroadcastCaptionWithoutSpace(t *testing.T) {
+	// A caption such as "/broadcast\n<b>Hello</b>", where the command is not followed by a space
+	message := &telego.Message{
+		Caption: "/broadcast\nHello",
+		CaptionEntities: []telego.MessageEntity{
+			{Type: "bot_command", Offset: 0, Length: 10},
+			{Type: "bold", Offset: 11, Length: 5},
+		},
+		Photo: []telego.PhotoSize{{FileID: "photo", FileUniqueID: "unique", Width: 1, Height: 1}},
+	}
+
+	params, _, _, reason := parseBroadcast(message, time.Now())
+	if reason != "" {
+		t.Fatalf("unexpected reason %q", reason)
+	}
+	if params.Media == nil || *params.Media != "photo" {
+		t.Fatalf("expected the photo to be relayed, got %v", params.Media)
+	}
+}
+
+func TestParseBroadcastShiftsEntities(t *testing.T) {
+	message := &telego.Message{
+		Text: "/broadcast to staff Hello",
+		Entities: []telego.MessageEntity{
+			{Type: "bot_command", Offset: 0, Length: 10},
+			{Type: "bold", Offset: 20, Length: 5},
+		},
+	}
+
+	params, _, segment, reason := parseBroadcast(message, time.Now())
+	if reason != "" {
+		t.Fatalf("unexpected reason %q", reason)
+	}
+	if segment == nil || segment.Type != "staff" {
+		t.Fatalf("expected the staff segment, got %v", segment)
+	}
+	if params.Text != "<b>Hello</b>" {
+		t.Fatalf("expected the bold text to be kept, got %q", params.Text)
+	}
+}
@@ -2,8 +2,11 @@ package database
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"regexp"
+	"slices"
 	"strings"
 	"time"
 
@@ -22,12 +25,114 @@ type Role struct {
 	Name     string `bson:"name"`
 	Onymity  string `bson:"onymity"`
 	RoleType string `bson:"role"`
+	// The name shown to users when Onymity is "pseudonym"; unique among roles
+	Pseudonym string `bson:"pseudonym,omitempty"`
+	// Set when the staff member has blocked the bot
+	Unreachable bool `bson:"unreachable,omitempty"`
 }
+
+// Returned when a pseudonym is already used by another role
+var ErrPseudonymTaken = errors.New("pseudonym is already taken")
+
+// Compare pseudonyms ignoring case
+var pseudonymCollation = &options.Collation{Locale: "en", Strength: 2}
+
 type Config struct {
-	Onymity    string  `bson:"defaultOnymity"`
-	UserReopen bool    `bson:"defaultUserReopen"`
-	RelayMedia bool    `bson:"relayMedia"`
-	Groups     []int64 `bson:"groups,omitempty"`
+	Onymity    string `bson:"defaultOnymity"`
+	UserReopen bool   `bson:"defaultUserReopen"`
+	// How many days after a ticket is closed its creator can still reopen it; 0 for no limit, and unset for the default
+	ReopenWindow  *int          `bson:"reopenWindow,omitempty"`
+	RelayMedia    bool          `bson:"relayMedia"`
+	MediaPolicies []MediaPolicy `bson:"mediaPolicies,omitempty"`
+	PromptTitle   bool          `bson:"promptTitle"`
+	// Changed with AddGroup, RemoveGroup, and ReplaceGroup, and not written by UpdateConfig
+	Groups []int64 `bson:"groups,omitempty"`
+	// Custom roles, and changes to the permissions of the default roles.
+	// These are edited in the database directly, and are not written by UpdateConfig.
+	Roles []RoleDefinition `bson:"roles,omitempty"`
+	// Set once the first owner has been appointed, after which ownership can only be transferred.
+	// Changed with ClaimOwnership, and not written by UpdateConfig.
+	OwnerClaimed bool `bson:"ownerClaimed,omitempty"`
+}
+
+// What staff with a role of this type are allowed to do
+type RoleDefinition struct {
+	Name string `bson:"name"`
+	// Staff can only give or take away roles ranked below their own
+	Rank        int      `bson:"rank"`
+	Permissions []string `bson:"permissions"`
+}
+
+const (
+	PermissionClose          = "close"
+	PermissionReopen         = "reopen"
+	PermissionAssign         = "assign"
+	PermissionBroadcast      = "broadcast"
+	PermissionManageRoles    = "manageRoles"
+	PermissionViewAllTickets = "viewAllTickets"
+	PermissionDeleteMessages = "deleteMessages"
+	PermissionBan            = "ban"
+	PermissionManageGroups   = "manageGroups"
+	PermissionEditTickets    = "editTickets"
+	PermissionViewStaff      = "viewStaff"
+	PermissionTransferOwner  = "transferOwner"
+)
+
+// How many days after a ticket is closed its creator can reopen it, unless the config says otherwise
+const DefaultReopenWindow = 7
+
+// The roles that exist without any configuration
+var DefaultRoles = []RoleDefinition{
+	{
+		Name: "support",
+		Rank: 1,
+		Permissions: []string{
+			PermissionClose,
+			PermissionReopen,
+			PermissionBan,
+			PermissionEditTickets,
+			PermissionViewStaff,
+		},
+	},
+	{
+		Name: "admin",
+		Rank: 2,
+		Permissions: []string{
+			PermissionClose,
+			PermissionReopen,
+			PermissionAssign,
+			PermissionManageRoles,
+			PermissionBan,
+			PermissionEditTickets,
+			PermissionViewStaff,
+		},
+	},
+	{
+		Name: "owner",
+		Rank: 3,
+		Permissions: []string{
+			PermissionClose,
+			PermissionReopen,
+			PermissionAssign,
+			PermissionBroadcast,
+			PermissionManageRoles,
+			PermissionViewAllTickets,
+			PermissionDeleteMessages,
+			PermissionBan,
+			PermissionManageGroups,
+			PermissionEditTickets,
+			PermissionViewStaff,
+			PermissionTransferOwner,
+		},
+	},
+}
+
+// Restrictions on relaying a type of media; types without a policy are allowed
+type MediaPolicy struct {
+	Type              string   `bson:"type"`
+	Allowed           bool     `bson:"allowed"`
+	MaxSize           int64    `bson:"maxSize,omitempty"`
+	BlockedExtensions []string `bson:"blockedExtensions,omitempty"`
 }
 
 type User struct {
@@ -37,7 +142,18 @@ type User struct {
 	Onymity            bool   `bson:"onymity"`
 	DisabledBroadcasts bool   `bson:"disabledBroadcasts"`
 	CanReopen          bool   `bson:"canReopen"`
-	Banned             bool   `bson:"banned"`
+	// Set when staff chose whether the user can reopen tickets; otherwise the default in the config applies
+	ReopenOverride bool `bson:"reopenOverride,omitempty"`
+	Banned         bool `bson:"banned"`
+	// When a temporary ban ends; nil if the ban is permanent
+	BannedUntil *time.Time `bson:"bannedUntil,omitempty"`
+	BanReason   string     `bson:"banReason,omitempty"`
+	// Set when the user has blocked the bot or deleted their account
+	Unreachable bool       `bson:"unreachable,omitempty"`
+	DateJoined  *time.Time `bson:"dateJoined,omitempty"`
+	// An IETF language tag, such as "en"; empty if the user has not chosen one
+	Language        string `bson:"language,omitempty"`
+	DisabledUpdates bool   `bson:"disabledUpdates,omitempty"`
 }
 
 type Ticket struct {
@@ -49,16 +165,137 @@ type Ticket struct {
 	Messages    []Message          `bson:"messages"`
 	ClosedBy    *int64             `bson:"closedBy"`
 	DateClosed  *time.Time         `bson:"dateClosed"`
+	TitlePrompt *int               `bson:"titlePrompt,omitempty"`
+	Category    string             `bson:"category,omitempty"`
+	// The topics of this ticket in forum groups
+	Topics []Topic `bson:"topics,omitempty"`
+}
+
+type Topic struct {
+	ChatID   int64 `bson:"chatID"`
+	ThreadID int   `bson:"threadID"`
+}
+
+type TicketSummary struct {
+	ID    primitive.ObjectID `bson:"_id"`
+	Title string             `bson:"title"`
 }
 
 type Message struct {
-	Sender        int64      `bson:"sender"`
-	OriginMSID    int        `bson:"originMSID"`
-	Receivers     []Receiver `bson:"receivers"`
-	DateSent      time.Time  `bson:"dateSent"`
-	Text          *string    `bson:"text"`
-	Media         *string    `bson:"media"`
-	UniqueMediaID *string    `bson:"uniqueMediaID,omitempty"`
+	Sender        int64       `bson:"sender"`
+	OriginMSID    int         `bson:"originMSID"`
+	Receivers     []Receiver  `bson:"receivers"`
+	DateSent      time.Time   `bson:"dateSent"`
+	Text          *string     `bson:"text"`
+	Media         *string     `bson:"media"`
+	UniqueMediaID *string     `bson:"uniqueMediaID,omitempty"`
+	MediaGroup    []Media     `bson:"mediaGroup,omitempty"`
+	Attachment    *Attachment `bson:"attachment,omitempty"`
+	Edits         []Edit      `bson:"edits,omitempty"`
+	Failures      []Failure   `bson:"failures,omitempty"`
+	DeletedBy     *int64      `bson:"deletedBy,omitempty"`
+	DateDeleted   *time.Time  `bson:"dateDeleted,omitempty"`
+}
+
+type Media struct {
+	Type          string  `bson:"type"`
+	FileID        string  `bson:"fileID"`
+	UniqueMediaID string  `bson:"uniqueMediaID"`
+	Caption       *string `bson:"caption,omitempty"`
+}
+
+// Message content without a file, such as a location, contact, or poll
+type Attachment struct {
+	Type        string   `bson:"type"`
+	Latitude    float64  `bson:"latitude,omitempty"`
+	Longitude   float64  `bson:"longitude,omitempty"`
+	Title       string   `bson:"title,omitempty"`
+	Address     string   `bson:"address,omitempty"`
+	PhoneNumber string   `bson:"phoneNumber,omitempty"`
+	FirstName   string   `bson:"firstName,omitempty"`
+	LastName    string   `bson:"lastName,omitempty"`
+	Question    string   `bson:"question,omitempty"`
+	Options     []string `bson:"options,omitempty"`
+	Emoji       string   `bson:"emoji,omitempty"`
+	Value       int      `bson:"value,omitempty"`
+	StoryChatID int64    `bson:"storyChatID,omitempty"`
+	StoryID     int      `bson:"storyID,omitempty"`
+}
+
+// A receiver that a message could not be delivered to
+type Failure struct {
+	UserID int64     `bson:"userID"`
+	Reason string    `bson:"reason"`
+	Date   time.Time `bson:"date"`
+}
+
+// A message waiting to be delivered again after a failed attempt
+type OutboxItem struct {
+	ID          primitive.ObjectID `bson:"_id"`
+	ChatID      int64              `bson:"chatID"`
+	TicketID    string             `bson:"ticketID,omitempty"`
+	BroadcastID string             `bson:"broadcastID,omitempty"`
+	Params      string             `bson:"params"`
+	Attempts    int                `bson:"attempts"`
+	NextAttempt time.Time          `bson:"nextAttempt"`
+	Status      string             `bson:"status"`
+	LastError   string             `bson:"lastError,omitempty"`
+	DateCreated time.Time          `bson:"dateCreated"`
+}
+
+// A broadcast written by an owner; drafts are sent once the owner confirms them
+type Broadcast struct {
+	ID          primitive.ObjectID `bson:"_id"`
+	Author      int64              `bson:"author"`
+	ChatID      int64              `bson:"chatID"`
+	OriginMSID  int                `bson:"originMSID"`
+	Params      string             `bson:"params"`
+	Status      string             `bson:"status"`
+	Preview     []int              `bson:"preview,omitempty"`
+	ControlMSID int                `bson:"controlMSID,omitempty"`
+	Schedule    *Schedule          `bson:"schedule,omitempty"`
+	Segment     *Segment           `bson:"segment,omitempty"`
+	// Each run of a repeating broadcast is stored separately, pointing back to the scheduled broadcast
+	TemplateID    *primitive.ObjectID `bson:"templateID,omitempty"`
+	Recipients    int                 `bson:"recipients,omitempty"`
+	Receivers     []Receiver          `bson:"receivers,omitempty"`
+	Failures      []Failure           `bson:"failures,omitempty"`
+	DateCreated   time.Time           `bson:"dateCreated"`
+	DateSent      *time.Time          `bson:"dateSent,omitempty"`
+	DateEdited    *time.Time          `bson:"dateEdited,omitempty"`
+	DateRetracted *time.Time          `bson:"dateRetracted,omitempty"`
+}
+
+// When a scheduled broadcast is sent, and how often it repeats
+type Schedule struct {
+	At     time.Time `bson:"at"`
+	Repeat string    `bson:"repeat,omitempty"`
+}
+
+// The users a broadcast is sent to; broadcasts without a segment are sent to every user.
+// Type is one of "open" (users with open tickets), "active" (users who sent a ticket message in the last Days days),
+// "joined" (users with a join date after Date), "category" (creators of tickets in Category), or "staff".
+type Segment struct {
+	Type     string     `bson:"type"`
+	Days     int        `bson:"days,omitempty"`
+	Date     *time.Time `bson:"date,omitempty"`
+	Category string     `bson:"category,omitempty"`
+}
+
+// A pending run of a scheduled broadcast
+type Job struct {
+	ID          primitive.ObjectID `bson:"_id"`
+	BroadcastID primitive.ObjectID `bson:"broadcastID"`
+	Author      int64              `bson:"author"`
+	NextRun     time.Time          `bson:"nextRun"`
+	Repeat      string             `bson:"repeat,omitempty"`
+	Status      string             `bson:"status"`
+	DateCreated time.Time          `bson:"dateCreated"`
+}
+
+type Edit struct {
+	Text       *string   `bson:"text"`
+	DateEdited time.Time `bson:"dateEdited"`
 }
 
 type Receiver struct {
@@ -104,7 +341,23 @@ func (db *Connection) CreateConfig() {
 		Onymity:    "realname",
 		UserReopen: false,
 		RelayMedia: true,
-		Groups:     nil,
+		MediaPolicies: []MediaPolicy{
+			{
+				Type:    "video",
+				Allowed: true,
+				MaxSize: 20 * 1024 * 1024,
+			},
+			{
+				Type:    "document",
+				Allowed: true,
+				BlockedExtensions: []string{
+					".apk", ".bat", ".cmd", ".com", ".exe", ".jar", ".js",
+					".msi", ".ps1", ".scr", ".sh", ".vbs",
+				},
+			},
+		},
+		PromptTitle: true,
+		Groups:      nil,
 	}
 
 	_, err := configColl.InsertOne(context.Background(), config)
@@ -116,6 +369,7 @@ func (db *Connection) CreateConfig() {
 func (db *Connection) CreateUser(id int64, username string, fullname string, config *Config) {
 	userColl := db.Client.Database("tbstb").Collection("users")
 
+	now := time.Now()
 	user := User{
 		ID:                 id,
 		Username:           username,
@@ -124,6 +378,7 @@ func (db *Connection) CreateUser(id int64, username string, fullname string, con
 		DisabledBroadcasts: false,
 		CanReopen:          config.UserReopen,
 		Banned:             false,
+		DateJoined:         &now,
 	}
 
 	_, err := userColl.InsertOne(context.Background(), user)
@@ -137,13 +392,7 @@ func (db *Connection) CreateTicket(creator int64, msid int, text *string, media
 
 	var title string
 	if text != nil {
-		rune_string := []rune(strings.Split(*text, "\n")[0])
-
-		if len(rune_string) > 50 {
-			rune_string = rune_string[:50]
-		}
-
-		title = string(rune_string)
+		title = MakeTitle(*text)
 	}
 
 	ticket := Ticket{
@@ -178,13 +427,20 @@ func (db *Connection) CreateTicket(creator int64, msid int, text *string, media
 	return id, id[len(id)-7:], &ticket
 }
 
-func (db *Connection) CreateRole(id int64, name string, roleType string, config *Config) {
-	roleColl := db.Client.Database("tbstb").Collection("roles")
+// Use the first line of the text, limited to 50 characters, as a ticket title
+func MakeTitle(text string) string {
+	rune_string := []rune(strings.TrimSpace(strings.Split(text, "\n")[0]))
 
-	if config.Onymity != "realname" {
-		name = ""
+	if len(rune_string) > 50 {
+		rune_string = rune_string[:50]
 	}
 
+	return string(rune_string)
+}
+
+func (db *Connection) CreateRole(id int64, name string, roleType string, config *Config) {
+	roleColl := db.Client.Database("tbstb").Collection("roles")
+
 	role := Role{
 		ID:       id,
 		Name:     name,
@@ -198,6 +454,96 @@ func (db *Connection) CreateRole(id int64, name string, roleType string, config
 	}
 }
 
+func (db *Connection) CreateOutboxItem(chatID int64, ticketID string, broadcastID string, params string, lastError string, nextAttempt time.Time) {
+	outboxColl := db.Client.Database("tbstb").Collection("outbox")
+
+	item := OutboxItem{
+		ID:          primitive.NewObjectID(),
+		ChatID:      chatID,
+		TicketID:    ticketID,
+		BroadcastID: broadcastID,
+		Params:      params,
+		Attempts:    1,
+		NextAttempt: nextAttempt,
+		Status:      "pending",
+		LastError:   lastError,
+		DateCreated: time.Now(),
+	}
+
+	_, err := outboxColl.InsertOne(context.Background(), item)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (db *Connection) CreateBroadcast(author int64, chatID int64, originMSID int, params string) *Broadcast {
+	broadcastColl := db.Client.Database("tbstb").Collection("broadcasts")
+
+	broadcast := Broadcast{
+		ID:          primitive.NewObjectID(),
+		Author:      author,
+		ChatID:      chatID,
+		OriginMSID:  originMSID,
+		Params:      params,
+		Status:      "draft",
+		DateCreated: time.Now(),
+	}
+
+	_, err := broadcastColl.InsertOne(context.Background(), broadcast)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return &broadcast
+}
+
+// Store a run of a repeating broadcast as a sent broadcast of its own
+func (db *Connection) CreateBroadcastRun(template *Broadcast) *Broadcast {
+	broadcastColl := db.Client.Database("tbstb").Collection("broadcasts")
+
+	now := time.Now()
+	broadcast := Broadcast{
+		ID:          primitive.NewObjectID(),
+		Author:      template.Author,
+		ChatID:      template.ChatID,
+		OriginMSID:  template.OriginMSID,
+		Params:      template.Params,
+		Status:      "sent",
+		Segment:     template.Segment,
+		TemplateID:  &template.ID,
+		DateCreated: now,
+		DateSent:    &now,
+	}
+
+	_, err := broadcastColl.InsertOne(context.Background(), broadcast)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return &broadcast
+}
+
+func (db *Connection) CreateJob(broadcastID primitive.ObjectID, author int64, nextRun time.Time, repeat string) *Job {
+	jobColl := db.Client.Database("tbstb").Collection("jobs")
+
+	job := Job{
+		ID:          primitive.NewObjectID(),
+		BroadcastID: broadcastID,
+		Author:      author,
+		NextRun:     nextRun,
+		Repeat:      repeat,
+		Status:      "pending",
+		DateCreated: time.Now(),
+	}
+
+	_, err := jobColl.InsertOne(context.Background(), job)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return &job
+}
+
 func (db *Connection) GetConfig() (*Config, error) {
 	configColl := db.Client.Database("tbstb").Collection("config")
 
@@ -222,7 +568,64 @@ func (db *Connection) GetUser(id int64) (*User, error) {
 	return &user, nil
 }
 
+// Get the user with the Telegram username, ignoring case and a leading "@"
+func (db *Connection) GetUserByUsername(username string) (*User, error) {
+	userColl := db.Client.Database("tbstb").Collection("users")
+
+	var user User
+	err := userColl.FindOne(context.Background(), bson.D{
+		{Key: "username", Value: bson.D{
+			{Key: "$regex", Value: "^" + regexp.QuoteMeta(strings.TrimPrefix(username, "@")) + "$"},
+			{Key: "$options", Value: "i"},
+		}},
+	}).Decode(&user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
 func (db *Connection) GetBroadcastableUsers(excludeID *int64) *[]int64 {
+	return db.findBroadcastableUsers(excludeID, nil)
+}
+
+// Get the users in a broadcast segment who can receive broadcasts.
+// Staff are sent broadcasts for their segment even if they have opted out.
+func (db *Connection) GetSegmentUsers(segment *Segment, excludeID *int64) *[]int64 {
+	if segment == nil {
+		return db.GetBroadcastableUsers(excludeID)
+	}
+
+	switch segment.Type {
+	case "staff":
+		ids := db.GetRoleIDs(excludeID)
+		return &ids
+	case "joined":
+		// Users created before join dates were recorded have none, and are never in this segment
+		return db.findBroadcastableUsers(excludeID, bson.D{
+			{Key: "dateJoined", Value: bson.D{{Key: "$gt", Value: segment.Date}}},
+		})
+	}
+
+	var creators []int64
+	switch segment.Type {
+	case "open":
+		creators = db.getTicketCreators(bson.D{{Key: "closedBy", Value: nil}})
+	case "category":
+		creators = db.getTicketCreators(bson.D{{Key: "category", Value: segment.Category}})
+	case "active":
+		creators = db.getActiveSenders(time.Now().AddDate(0, 0, -segment.Days))
+	default:
+		return nil
+	}
+
+	return db.findBroadcastableUsers(excludeID, bson.D{
+		{Key: "_id", Value: bson.D{{Key: "$in", Value: creators}}},
+	})
+}
+
+func (db *Connection) findBroadcastableUsers(excludeID *int64, extra bson.D) *[]int64 {
 	userColl := db.Client.Database("tbstb").Collection("users")
 
 	filter := bson.D{
@@ -231,6 +634,12 @@ func (db *Connection) GetBroadcastableUsers(excludeID *int64) *[]int64 {
 		}},
 		{Key: "disabledBroadcasts", Value: false},
 		{Key: "banned", Value: false},
+		{Key: "unreachable", Value: bson.D{{Key: "$ne", Value: true}}},
+	}
+
+	// Combine with $and, since the extra conditions may also be on _id
+	if extra != nil {
+		filter = bson.D{{Key: "$and", Value: bson.A{filter, extra}}}
 	}
 
 	values, err := userColl.Distinct(context.Background(), "_id", filter)
@@ -249,6 +658,84 @@ func (db *Connection) GetBroadcastableUsers(excludeID *int64) *[]int64 {
 	return &userIDs
 }
 
+// Get the creators of the tickets matching the filter
+func (db *Connection) getTicketCreators(filter bson.D) []int64 {
+	ticketColl := db.Client.Database("tbstb").Collection("tickets")
+
+	values, err := ticketColl.Distinct(context.Background(), "creator", filter)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var creators []int64
+	for _, val := range values {
+		if id, ok := val.(int64); ok {
+			creators = append(creators, id)
+		}
+	}
+
+	return creators
+}
+
+// Get the users who have sent a ticket message since the given date
+func (db *Connection) getActiveSenders(since time.Time) []int64 {
+	ticketColl := db.Client.Database("tbstb").Collection("tickets")
+
+	cursor, err := ticketColl.Aggregate(context.Background(), mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "messages.dateSent", Value: bson.D{{Key: "$gte", Value: since}}}}}},
+		{{Key: "$unwind", Value: "$messages"}},
+		{{Key: "$match", Value: bson.D{{Key: "messages.dateSent", Value: bson.D{{Key: "$gte", Value: since}}}}}},
+		{{Key: "$group", Value: bson.D{{Key: "_id", Value: "$messages.sender"}}}},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var results []struct {
+		ID int64 `bson:"_id"`
+	}
+	err = cursor.All(context.Background(), &results)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var senders []int64
+	for _, result := range results {
+		senders = append(senders, result.ID)
+	}
+
+	return senders
+}
+
+// Check whether any staff member is an owner
+func (db *Connection) HasOwner() bool {
+	roleColl := db.Client.Database("tbstb").Collection("roles")
+
+	count, err := roleColl.CountDocuments(context.Background(), bson.D{{Key: "role", Value: "owner"}})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return count > 0
+}
+
+// Claim the ownership of the bot for the first owner.
+// Returns false if it has already been claimed, so only one caller can ever succeed.
+func (db *Connection) ClaimOwnership() bool {
+	configColl := db.Client.Database("tbstb").Collection("config")
+
+	result, err := configColl.UpdateOne(
+		context.Background(),
+		bson.D{{Key: "ownerClaimed", Value: bson.D{{Key: "$ne", Value: true}}}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "ownerClaimed", Value: true}}}},
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return result.ModifiedCount > 0
+}
+
 func (db *Connection) GetUserCount() int64 {
 	userColl := db.Client.Database("tbstb").Collection("users")
 
@@ -308,6 +795,48 @@ func (db *Connection) GetTicketIDs(id int64) []string {
 	return ticket_strings
 }
 
+func (db *Connection) GetTicketSummaries(id int64) []TicketSummary {
+	ticketColl := db.Client.Database("tbstb").Collection("tickets")
+
+	var summaries []TicketSummary
+	cursor, err := ticketColl.Find(context.Background(), bson.D{{
+		Key: "creator", Value: bson.D{{Key: "$eq", Value: id}},
+	}},
+		options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}, {Key: "title", Value: 1}}))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = cursor.All(context.Background(), &summaries)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return summaries
+}
+
+// Get the ID and title of each ticket created by the user that is still open
+func (db *Connection) GetOpenTicketSummaries(id int64) []TicketSummary {
+	ticketColl := db.Client.Database("tbstb").Collection("tickets")
+
+	var summaries []TicketSummary
+	cursor, err := ticketColl.Find(context.Background(), bson.D{
+		{Key: "creator", Value: bson.D{{Key: "$eq", Value: id}}},
+		{Key: "closedBy", Value: nil},
+	},
+		options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}, {Key: "title", Value: 1}}))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = cursor.All(context.Background(), &summaries)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return summaries
+}
+
 func (db *Connection) GetTicketFromMSID(msid int, userID int64) (string, string, *Ticket) {
 	ticketColl := db.Client.Database("tbstb").Collection("tickets")
 
@@ -326,6 +855,47 @@ func (db *Connection) GetTicketFromMSID(msid int, userID int64) (string, string,
 	return id, id[len(id)-7:], &ticket
 }
 
+// Get the ticket that has the topic in a forum group
+func (db *Connection) GetTicketFromTopic(chatID int64, threadID int) (string, string, *Ticket) {
+	ticketColl := db.Client.Database("tbstb").Collection("tickets")
+
+	var ticket Ticket
+
+	err := ticketColl.FindOne(context.Background(), bson.D{
+		{Key: "topics", Value: bson.D{
+			{Key: "$elemMatch", Value: bson.D{
+				{Key: "chatID", Value: chatID},
+				{Key: "threadID", Value: threadID},
+			}},
+		}},
+	}).Decode(&ticket)
+	if err != nil {
+		return "", "", nil
+	}
+
+	id := ticket.ID.Hex()
+
+	return id, id[len(id)-7:], &ticket
+}
+
+func (db *Connection) GetTicketFromTitlePrompt(msid int, userID int64) (string, string, *Ticket) {
+	ticketColl := db.Client.Database("tbstb").Collection("tickets")
+
+	var ticket Ticket
+
+	err := ticketColl.FindOne(context.Background(), bson.D{
+		{Key: "creator", Value: userID},
+		{Key: "titlePrompt", Value: msid},
+	}).Decode(&ticket)
+	if err != nil {
+		return "", "", nil
+	}
+
+	id := ticket.ID.Hex()
+
+	return id, id[len(id)-7:], &ticket
+}
+
 func (db *Connection) GetTicketAndMessage(msid int, userID int64) (string, *Ticket, *Message) {
 	ticketColl := db.Client.Database("tbstb").Collection("tickets")
 
@@ -350,6 +920,7 @@ func (db *Connection) GetTicketAndMessage(msid int, userID int64) (string, *Tick
 			}},
 			{Key: "closedBy", Value: 1},
 			{Key: "dateClosed", Value: 1},
+			{Key: "topics", Value: 1},
 		})).Decode(&object)
 	if err != nil {
 		return "", nil, nil
@@ -358,32 +929,86 @@ func (db *Connection) GetTicketAndMessage(msid int, userID int64) (string, *Tick
 	return object.ID.Hex(), &object, &object.Messages[0]
 }
 
-func (db *Connection) GetRole(id int64) (*Role, error) {
-	roleColl := db.Client.Database("tbstb").Collection("roles")
-
-	var role Role
-	err := roleColl.FindOne(context.Background(), bson.D{{Key: "_id", Value: id}}).Decode(&role)
-	if err != nil {
-		return nil, err
-	}
-
-	return &role, nil
-}
-
-func (db *Connection) GetRoleIDs(exclude *int64) []int64 {
-	roleColl := db.Client.Database("tbstb").Collection("roles")
+func (db *Connection) GetTicketAndOrigin(msid int, sender int64) (string, *Ticket, *Message) {
+	ticketColl := db.Client.Database("tbstb").Collection("tickets")
 
-	type RoleID struct {
-		ID int64 `bson:"_id"`
-	}
+	var object Ticket
 
-	var roles []RoleID
-	var ids []int64
-	cursor, err := roleColl.Find(context.Background(), bson.D{},
-		options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}}),
-	)
-	if err != nil {
-		log.Fatal(err)
+	err := ticketColl.FindOne(context.Background(), bson.D{
+		{Key: "messages", Value: bson.D{
+			{Key: "$elemMatch", Value: bson.D{
+				{Key: "sender", Value: sender},
+				{Key: "originMSID", Value: msid},
+			}},
+		}},
+	},
+		options.FindOne().SetProjection(bson.D{
+			{Key: "_id", Value: 1},
+			{Key: "creator", Value: 1},
+			{Key: "title", Value: 1},
+			{Key: "dateCreated", Value: 1},
+			{Key: "assignees", Value: 1},
+			{Key: "messages", Value: bson.D{
+				{Key: "$elemMatch", Value: bson.D{
+					{Key: "sender", Value: sender},
+					{Key: "originMSID", Value: msid},
+				},
+				},
+			}},
+			{Key: "closedBy", Value: 1},
+			{Key: "dateClosed", Value: 1},
+			{Key: "topics", Value: 1},
+		})).Decode(&object)
+	if err != nil {
+		return "", nil, nil
+	}
+
+	return object.ID.Hex(), &object, &object.Messages[0]
+}
+
+func (db *Connection) GetRole(id int64) (*Role, error) {
+	roleColl := db.Client.Database("tbstb").Collection("roles")
+
+	var role Role
+	err := roleColl.FindOne(context.Background(), bson.D{{Key: "_id", Value: id}}).Decode(&role)
+	if err != nil {
+		return nil, err
+	}
+
+	return &role, nil
+}
+
+// Get the role using the pseudonym, ignoring case
+func (db *Connection) GetRoleByPseudonym(pseudonym string) (*Role, error) {
+	roleColl := db.Client.Database("tbstb").Collection("roles")
+
+	var role Role
+	err := roleColl.FindOne(context.Background(), bson.D{{Key: "pseudonym", Value: pseudonym}},
+		options.FindOne().SetCollation(pseudonymCollation),
+	).Decode(&role)
+	if err != nil {
+		return nil, err
+	}
+
+	return &role, nil
+}
+
+func (db *Connection) GetRoleIDs(exclude *int64) []int64 {
+	roleColl := db.Client.Database("tbstb").Collection("roles")
+
+	type RoleID struct {
+		ID int64 `bson:"_id"`
+	}
+
+	var roles []RoleID
+	var ids []int64
+	cursor, err := roleColl.Find(context.Background(), bson.D{
+		{Key: "unreachable", Value: bson.D{{Key: "$ne", Value: true}}},
+	},
+		options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}}),
+	)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	err = cursor.All(context.Background(), &roles)
@@ -423,6 +1048,190 @@ func (db *Connection) GetAllRoles() []Role {
 	return roles
 }
 
+// Get the pending outbox items that are due for another delivery attempt
+func (db *Connection) GetDueOutboxItems() []OutboxItem {
+	outboxColl := db.Client.Database("tbstb").Collection("outbox")
+
+	var items []OutboxItem
+	cursor, err := outboxColl.Find(context.Background(), bson.D{
+		{Key: "status", Value: "pending"},
+		{Key: "nextAttempt", Value: bson.D{{Key: "$lte", Value: time.Now()}}},
+	},
+		options.Find().SetSort(bson.D{{Key: "nextAttempt", Value: 1}}),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = cursor.All(context.Background(), &items)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return items
+}
+
+func (db *Connection) GetBroadcast(id string) (*Broadcast, error) {
+	broadcastColl := db.Client.Database("tbstb").Collection("broadcasts")
+
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var broadcast Broadcast
+	err = broadcastColl.FindOne(context.Background(), bson.D{{Key: "_id", Value: oid}}).Decode(&broadcast)
+	if err != nil {
+		return nil, err
+	}
+
+	return &broadcast, nil
+}
+
+// Get the broadcast written by the command message with the given ID
+func (db *Connection) GetBroadcastFromOrigin(chatID int64, originMSID int) (*Broadcast, error) {
+	broadcastColl := db.Client.Database("tbstb").Collection("broadcasts")
+
+	var broadcast Broadcast
+	err := broadcastColl.FindOne(context.Background(), bson.D{
+		{Key: "chatID", Value: chatID},
+		{Key: "originMSID", Value: originMSID},
+		{Key: "templateID", Value: bson.D{{Key: "$exists", Value: false}}},
+	}).Decode(&broadcast)
+	if err != nil {
+		return nil, err
+	}
+
+	return &broadcast, nil
+}
+
+// Get the broadcasts that have been sent, most recent first
+func (db *Connection) GetSentBroadcasts(limit int64) []Broadcast {
+	broadcastColl := db.Client.Database("tbstb").Collection("broadcasts")
+
+	var broadcasts []Broadcast
+	cursor, err := broadcastColl.Find(context.Background(), bson.D{
+		{Key: "status", Value: bson.D{{Key: "$in", Value: []string{"sent", "retracted"}}}},
+	},
+		options.Find().SetSort(bson.D{{Key: "dateSent", Value: -1}}).SetLimit(limit),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = cursor.All(context.Background(), &broadcasts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return broadcasts
+}
+
+// Get the most recent broadcast that has been sent whose ID ends with the given characters
+func (db *Connection) GetSentBroadcast(shortID string) (*Broadcast, error) {
+	broadcastColl := db.Client.Database("tbstb").Collection("broadcasts")
+
+	var broadcast Broadcast
+	err := broadcastColl.FindOne(context.Background(), bson.D{
+		{Key: "status", Value: bson.D{{Key: "$in", Value: []string{"sent", "retracted"}}}},
+		{Key: "$expr", Value: bson.D{{Key: "$regexMatch", Value: bson.D{
+			{Key: "input", Value: bson.D{{Key: "$toString", Value: "$_id"}}},
+			{Key: "regex", Value: regexp.QuoteMeta(strings.ToLower(shortID)) + "$"},
+		}}}},
+	},
+		options.FindOne().SetSort(bson.D{{Key: "dateSent", Value: -1}}),
+	).Decode(&broadcast)
+	if err != nil {
+		return nil, err
+	}
+
+	return &broadcast, nil
+}
+
+// Get the current status of a broadcast, or an empty string if it does not exist
+func (db *Connection) GetBroadcastStatus(broadcastID string) string {
+	broadcastColl := db.Client.Database("tbstb").Collection("broadcasts")
+
+	id, err := primitive.ObjectIDFromHex(broadcastID)
+	if err != nil {
+		return ""
+	}
+
+	var broadcast Broadcast
+	err = broadcastColl.FindOne(context.Background(), bson.D{{Key: "_id", Value: id}},
+		options.FindOne().SetProjection(bson.D{{Key: "status", Value: 1}}),
+	).Decode(&broadcast)
+	if err != nil {
+		return ""
+	}
+
+	return broadcast.Status
+}
+
+// Count the copies of a broadcast that are still waiting to be delivered again
+func (db *Connection) CountPendingOutboxItems(broadcastID string) int64 {
+	outboxColl := db.Client.Database("tbstb").Collection("outbox")
+
+	count, err := outboxColl.CountDocuments(context.Background(), bson.D{
+		{Key: "broadcastID", Value: broadcastID},
+		{Key: "status", Value: "pending"},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return count
+}
+
+func (db *Connection) GetJob(id string) (*Job, error) {
+	jobColl := db.Client.Database("tbstb").Collection("jobs")
+
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var job Job
+	err = jobColl.FindOne(context.Background(), bson.D{{Key: "_id", Value: oid}}).Decode(&job)
+	if err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+// Get the pending jobs, soonest first
+func (db *Connection) GetPendingJobs() []Job {
+	return db.findJobs(bson.D{{Key: "status", Value: "pending"}})
+}
+
+// Get the pending jobs that are due to run
+func (db *Connection) GetDueJobs() []Job {
+	return db.findJobs(bson.D{
+		{Key: "status", Value: "pending"},
+		{Key: "nextRun", Value: bson.D{{Key: "$lte", Value: time.Now()}}},
+	})
+}
+
+func (db *Connection) findJobs(filter bson.D) []Job {
+	jobColl := db.Client.Database("tbstb").Collection("jobs")
+
+	var jobs []Job
+	cursor, err := jobColl.Find(context.Background(), filter,
+		options.Find().SetSort(bson.D{{Key: "nextRun", Value: 1}}),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = cursor.All(context.Background(), &jobs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return jobs
+}
+
 func (db *Connection) GetRoleReceivers(excludeSender *int64) []int64 {
 	users := db.GetRoleIDs(excludeSender)
 
@@ -431,7 +1240,11 @@ func (db *Connection) GetRoleReceivers(excludeSender *int64) []int64 {
 
 func (db *Connection) GetOriginReceivers(excludeRole *int64, origin int64) []int64 {
 	users := db.GetRoleIDs(excludeRole)
-	users = append(users, origin)
+
+	user, err := db.GetUser(origin)
+	if err != nil || !user.Unreachable {
+		users = append(users, origin)
+	}
 
 	return users
 }
@@ -445,10 +1258,20 @@ func (db *Connection) GetGroupReceivers() []int64 {
 	return config.Groups
 }
 
-func (db *Connection) GetAssigneeReceivers(users []int64) []int64 {
+func (db *Connection) GetAssigneeReceivers(assignees []int64) []int64 {
+	var users []int64
+
+	config, err := db.GetConfig()
+	if err != nil {
+		return nil
+	}
+
 	roles := db.GetAllRoles()
 	for _, role := range roles {
-		if role.RoleType == "owner" {
+		if role.Unreachable {
+			continue
+		}
+		if config.HasPermission(role.RoleType, PermissionViewAllTickets) || slices.Contains(assignees, role.ID) {
 			users = append(users, role.ID)
 		}
 	}
@@ -456,22 +1279,81 @@ func (db *Connection) GetAssigneeReceivers(users []int64) []int64 {
 	return users
 }
 
+// Register a group to receive tickets; returns false if it was already registered
+func (db *Connection) AddGroup(id int64) bool {
+	return db.updateGroups(bson.D{{Key: "$addToSet", Value: bson.D{{Key: "groups", Value: id}}}})
+}
+
+// Unregister a group; returns false if it was not registered
+func (db *Connection) RemoveGroup(id int64) bool {
+	return db.updateGroups(bson.D{{Key: "$pull", Value: bson.D{{Key: "groups", Value: id}}}})
+}
+
+// Replace the ID of a group that has been migrated to a supergroup
+func (db *Connection) ReplaceGroup(oldID int64, newID int64) bool {
+	if !db.RemoveGroup(oldID) {
+		return false
+	}
+
+	db.AddGroup(newID)
+	return true
+}
+
+// Remove duplicate groups, which could be registered more than once by older versions
+func (db *Connection) DedupeGroups() []int64 {
+	config, err := db.GetConfig()
+	if err != nil {
+		return nil
+	}
+
+	var groups []int64
+	for _, id := range config.Groups {
+		if !slices.Contains(groups, id) {
+			groups = append(groups, id)
+		}
+	}
+
+	if len(groups) != len(config.Groups) {
+		db.updateGroups(bson.D{{Key: "$set", Value: bson.D{{Key: "groups", Value: groups}}}})
+	}
+
+	return groups
+}
+
+func (db *Connection) updateGroups(update bson.D) bool {
+	configColl := db.Client.Database("tbstb").Collection("config")
+
+	result, err := configColl.UpdateOne(context.Background(), bson.D{}, update)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return result.ModifiedCount > 0
+}
+
 func (db *Connection) UpdateConfig(config *Config) *Config {
 	configColl := db.Client.Database("tbstb").Collection("config")
 
+	set := bson.D{
+		{Key: "defaultOnymity", Value: config.Onymity},
+		{Key: "defaultUserReopen", Value: config.UserReopen},
+		{Key: "relayMedia", Value: config.RelayMedia},
+		{Key: "mediaPolicies", Value: config.MediaPolicies},
+		{Key: "promptTitle", Value: config.PromptTitle},
+	}
+	update := bson.D{}
+	if config.ReopenWindow != nil {
+		set = append(set, bson.E{Key: "reopenWindow", Value: *config.ReopenWindow})
+	} else {
+		update = append(update, bson.E{Key: "$unset", Value: bson.D{{Key: "reopenWindow", Value: ""}}})
+	}
+	update = append(update, bson.E{Key: "$set", Value: set})
+
 	var updatedConfig Config
 	err := configColl.FindOneAndUpdate(
 		context.Background(),
 		bson.D{},
-		bson.D{{
-			Key: "$set",
-			Value: bson.D{
-				{Key: "defaultOnymity", Value: config.Onymity},
-				{Key: "defaultUserReopen", Value: config.UserReopen},
-				{Key: "relayMedia", Value: config.RelayMedia},
-				{Key: "groups", Value: config.Groups},
-			},
-		}},
+		update,
 	).Decode(&updatedConfig)
 
 	if err != nil {
@@ -487,20 +1369,39 @@ func (db *Connection) UpdateConfig(config *Config) *Config {
 func (db *Connection) UpdateUser(user *User) {
 	userColl := db.Client.Database("tbstb").Collection("users")
 
+	set := bson.D{
+		{Key: "username", Value: user.Username},
+		{Key: "fullname", Value: user.Fullname},
+		{Key: "banned", Value: user.Banned},
+		{Key: "onymity", Value: user.Onymity},
+		{Key: "disabledBroadcasts", Value: user.DisabledBroadcasts},
+		{Key: "canReopen", Value: user.CanReopen},
+		{Key: "reopenOverride", Value: user.ReopenOverride},
+		{Key: "language", Value: user.Language},
+		{Key: "disabledUpdates", Value: user.DisabledUpdates},
+	}
+	unset := bson.D{}
+
+	if user.BannedUntil != nil {
+		set = append(set, bson.E{Key: "bannedUntil", Value: user.BannedUntil})
+	} else {
+		unset = append(unset, bson.E{Key: "bannedUntil", Value: ""})
+	}
+	if user.BanReason != "" {
+		set = append(set, bson.E{Key: "banReason", Value: user.BanReason})
+	} else {
+		unset = append(unset, bson.E{Key: "banReason", Value: ""})
+	}
+
+	update := bson.D{{Key: "$set", Value: set}}
+	if len(unset) > 0 {
+		update = append(update, bson.E{Key: "$unset", Value: unset})
+	}
+
 	_, err := userColl.UpdateOne(
 		context.Background(),
 		bson.D{{Key: "_id", Value: user.ID}},
-		bson.D{{
-			Key: "$set",
-			Value: bson.D{
-				{Key: "username", Value: user.Username},
-				{Key: "fullname", Value: user.Fullname},
-				{Key: "banned", Value: user.Banned},
-				{Key: "onymity", Value: user.Onymity},
-				{Key: "disabledBroadcasts", Value: user.DisabledBroadcasts},
-				{Key: "canReopen", Value: user.CanReopen},
-			},
-		}},
+		update,
 	)
 	if err != nil {
 		log.Fatal(err)
@@ -523,6 +1424,8 @@ func (db *Connection) UpdateTicket(id string, ticket *Ticket) {
 				{Key: "messages", Value: ticket.Messages},
 				{Key: "closedBy", Value: ticket.ClosedBy},
 				{Key: "dateClosed", Value: ticket.DateClosed},
+				{Key: "titlePrompt", Value: ticket.TitlePrompt},
+				{Key: "category", Value: ticket.Category},
 			},
 		}},
 	)
@@ -549,6 +1452,8 @@ func (db *Connection) AppendMessage(ticket_id string, message *Message) {
 				{Key: "text", Value: message.Text},
 				{Key: "media", Value: message.Media},
 				{Key: "uniqueMediaID", Value: message.UniqueMediaID},
+				{Key: "mediaGroup", Value: message.MediaGroup},
+				{Key: "attachment", Value: message.Attachment},
 			}}},
 		}},
 	)
@@ -557,6 +1462,435 @@ func (db *Connection) AppendMessage(ticket_id string, message *Message) {
 	}
 }
 
+// Replace the text of a message and record the previous text in its edit history
+func (db *Connection) EditMessage(ticket_id string, message *Message, text *string) {
+	ticketColl := db.Client.Database("tbstb").Collection("tickets")
+
+	id, err := primitive.ObjectIDFromHex(ticket_id)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = ticketColl.UpdateOne(context.Background(), bson.D{
+		{Key: "_id", Value: id},
+		{Key: "messages", Value: bson.D{
+			{Key: "$elemMatch", Value: bson.D{
+				{Key: "sender", Value: message.Sender},
+				{Key: "originMSID", Value: message.OriginMSID},
+			}},
+		}},
+	},
+		bson.D{
+			{Key: "$set", Value: bson.D{
+				{Key: "messages.$.text", Value: text},
+			}},
+			{Key: "$push", Value: bson.D{
+				{Key: "messages.$.edits", Value: Edit{
+					Text:       message.Text,
+					DateEdited: time.Now(),
+				}},
+			}},
+		},
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Mark a message as deleted; its content is kept as an audit record
+func (db *Connection) DeleteMessage(ticket_id string, message *Message, deletedBy int64) {
+	ticketColl := db.Client.Database("tbstb").Collection("tickets")
+
+	id, err := primitive.ObjectIDFromHex(ticket_id)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = ticketColl.UpdateOne(context.Background(), bson.D{
+		{Key: "_id", Value: id},
+		{Key: "messages", Value: bson.D{
+			{Key: "$elemMatch", Value: bson.D{
+				{Key: "sender", Value: message.Sender},
+				{Key: "originMSID", Value: message.OriginMSID},
+			}},
+		}},
+	},
+		bson.D{
+			{Key: "$set", Value: bson.D{
+				{Key: "messages.$.deletedBy", Value: deletedBy},
+				{Key: "messages.$.dateDeleted", Value: time.Now()},
+			}},
+		},
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Set the title of a ticket, which also answers any title prompt
+func (db *Connection) SetTicketTitle(ticket_id string, title string) {
+	db.updateTicketByID(ticket_id, bson.D{
+		{Key: "$set", Value: bson.D{{Key: "title", Value: title}}},
+		{Key: "$unset", Value: bson.D{{Key: "titlePrompt", Value: ""}}},
+	})
+}
+
+// Close a ticket, or reopen it when closedBy and dateClosed are nil
+func (db *Connection) SetTicketClosed(ticket_id string, closedBy *int64, dateClosed *time.Time) {
+	db.updateTicketByID(ticket_id, bson.D{{
+		Key: "$set",
+		Value: bson.D{
+			{Key: "closedBy", Value: closedBy},
+			{Key: "dateClosed", Value: dateClosed},
+		},
+	}})
+}
+
+// Set the staff members a ticket is assigned to
+func (db *Connection) SetTicketAssignees(ticket_id string, assignees []int64) {
+	db.updateTicketByID(ticket_id, bson.D{{Key: "$set", Value: bson.D{{Key: "assignees", Value: assignees}}}})
+}
+
+// Set the category of a ticket, or remove it if the category is empty
+func (db *Connection) SetTicketCategory(ticket_id string, category string) {
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "category", Value: category}}}}
+	if category == "" {
+		update = bson.D{{Key: "$unset", Value: bson.D{{Key: "category", Value: ""}}}}
+	}
+
+	db.updateTicketByID(ticket_id, update)
+}
+
+func (db *Connection) updateTicketByID(ticket_id string, update bson.D) {
+	ticketColl := db.Client.Database("tbstb").Collection("tickets")
+
+	id, err := primitive.ObjectIDFromHex(ticket_id)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = ticketColl.UpdateOne(context.Background(), bson.D{{Key: "_id", Value: id}}, update)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (db *Connection) UpdateTitlePrompt(ticket_id string, msid *int) {
+	ticketColl := db.Client.Database("tbstb").Collection("tickets")
+
+	id, err := primitive.ObjectIDFromHex(ticket_id)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = ticketColl.UpdateOne(
+		context.Background(),
+		bson.D{{Key: "_id", Value: id}},
+		bson.D{{
+			Key:   "$set",
+			Value: bson.D{{Key: "titlePrompt", Value: msid}},
+		}},
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Add receivers to a message after it has been delivered to them
+func (db *Connection) AppendReceivers(ticket_id string, sender int64, originMSID int, receivers []Receiver) {
+	if len(receivers) == 0 {
+		return
+	}
+
+	ticketColl := db.Client.Database("tbstb").Collection("tickets")
+
+	id, err := primitive.ObjectIDFromHex(ticket_id)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = ticketColl.UpdateOne(context.Background(), bson.D{
+		{Key: "_id", Value: id},
+		{Key: "messages", Value: bson.D{
+			{Key: "$elemMatch", Value: bson.D{
+				{Key: "sender", Value: sender},
+				{Key: "originMSID", Value: originMSID},
+			}},
+		}},
+	},
+		bson.D{{Key: "$push", Value: bson.D{
+			{Key: "messages.$.receivers", Value: bson.D{{Key: "$each", Value: receivers}}},
+		}}},
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Add a topic to a ticket, unless the ticket already has a topic in the same group.
+// Returns false if it did, such as when two messages created a topic at the same time.
+func (db *Connection) AppendTopic(ticket_id string, topic *Topic) bool {
+	ticketColl := db.Client.Database("tbstb").Collection("tickets")
+
+	oid, err := primitive.ObjectIDFromHex(ticket_id)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	result, err := ticketColl.UpdateOne(
+		context.Background(),
+		bson.D{
+			{Key: "_id", Value: oid},
+			{Key: "topics.chatID", Value: bson.D{{Key: "$ne", Value: topic.ChatID}}},
+		},
+		bson.D{{Key: "$push", Value: bson.D{{Key: "topics", Value: topic}}}},
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return result.ModifiedCount > 0
+}
+
+// Record a receiver that a message could not be delivered to
+func (db *Connection) AppendFailure(ticket_id string, sender int64, originMSID int, failure *Failure) {
+	ticketColl := db.Client.Database("tbstb").Collection("tickets")
+
+	id, err := primitive.ObjectIDFromHex(ticket_id)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = ticketColl.UpdateOne(context.Background(), bson.D{
+		{Key: "_id", Value: id},
+		{Key: "messages", Value: bson.D{
+			{Key: "$elemMatch", Value: bson.D{
+				{Key: "sender", Value: sender},
+				{Key: "originMSID", Value: originMSID},
+			}},
+		}},
+	},
+		bson.D{{Key: "$push", Value: bson.D{
+			{Key: "messages.$.failures", Value: failure},
+		}}},
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (db *Connection) UpdateOutboxItem(item *OutboxItem) {
+	outboxColl := db.Client.Database("tbstb").Collection("outbox")
+
+	_, err := outboxColl.UpdateOne(
+		context.Background(),
+		bson.D{{Key: "_id", Value: item.ID}},
+		bson.D{{
+			Key: "$set",
+			Value: bson.D{
+				{Key: "attempts", Value: item.Attempts},
+				{Key: "nextAttempt", Value: item.NextAttempt},
+				{Key: "status", Value: item.Status},
+				{Key: "lastError", Value: item.LastError},
+			},
+		}},
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (db *Connection) DeleteOutboxItem(id primitive.ObjectID) {
+	outboxColl := db.Client.Database("tbstb").Collection("outbox")
+
+	_, err := outboxColl.DeleteOne(context.Background(), bson.D{{Key: "_id", Value: id}})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Stop retrying the copies of a broadcast that have not been delivered yet
+func (db *Connection) DeletePendingOutboxItems(broadcastID string) {
+	outboxColl := db.Client.Database("tbstb").Collection("outbox")
+
+	_, err := outboxColl.DeleteMany(context.Background(), bson.D{
+		{Key: "broadcastID", Value: broadcastID},
+		{Key: "status", Value: "pending"},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (db *Connection) UpdateBroadcast(broadcast *Broadcast) {
+	broadcastColl := db.Client.Database("tbstb").Collection("broadcasts")
+
+	set := bson.D{
+		{Key: "params", Value: broadcast.Params},
+		{Key: "preview", Value: broadcast.Preview},
+		{Key: "controlMSID", Value: broadcast.ControlMSID},
+	}
+
+	unset := bson.D{}
+	if broadcast.Schedule != nil {
+		set = append(set, bson.E{Key: "schedule", Value: broadcast.Schedule})
+	} else {
+		unset = append(unset, bson.E{Key: "schedule", Value: ""})
+	}
+	if broadcast.Segment != nil {
+		set = append(set, bson.E{Key: "segment", Value: broadcast.Segment})
+	} else {
+		unset = append(unset, bson.E{Key: "segment", Value: ""})
+	}
+
+	update := bson.D{{Key: "$set", Value: set}}
+	if len(unset) > 0 {
+		update = append(update, bson.E{Key: "$unset", Value: unset})
+	}
+
+	_, err := broadcastColl.UpdateOne(
+		context.Background(),
+		bson.D{{Key: "_id", Value: broadcast.ID}},
+		update,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (db *Connection) SetBroadcastRecipients(id primitive.ObjectID, recipients int) {
+	db.updateBroadcastByID(id, bson.D{{Key: "$set", Value: bson.D{{Key: "recipients", Value: recipients}}}})
+}
+
+// Add the copies of a broadcast that have been delivered
+func (db *Connection) AppendBroadcastReceivers(broadcastID string, receivers []Receiver) {
+	if len(receivers) == 0 {
+		return
+	}
+
+	id, err := primitive.ObjectIDFromHex(broadcastID)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db.updateBroadcastByID(id, bson.D{{
+		Key:   "$push",
+		Value: bson.D{{Key: "receivers", Value: bson.D{{Key: "$each", Value: receivers}}}},
+	}})
+}
+
+// Record a user that a broadcast could not be delivered to
+func (db *Connection) AppendBroadcastFailure(broadcastID string, failure *Failure) {
+	id, err := primitive.ObjectIDFromHex(broadcastID)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db.updateBroadcastByID(id, bson.D{{Key: "$push", Value: bson.D{{Key: "failures", Value: failure}}}})
+}
+
+// Replace the content of a broadcast that has been sent, after its copies have been edited
+func (db *Connection) EditBroadcast(id primitive.ObjectID, params string) {
+	db.updateBroadcastByID(id, bson.D{{
+		Key: "$set",
+		Value: bson.D{
+			{Key: "params", Value: params},
+			{Key: "dateEdited", Value: time.Now()},
+		},
+	}})
+}
+
+// Mark a broadcast as retracted, after its copies have been deleted
+func (db *Connection) RetractBroadcast(id primitive.ObjectID) {
+	db.updateBroadcastByID(id, bson.D{{
+		Key: "$set",
+		Value: bson.D{
+			{Key: "status", Value: "retracted"},
+			{Key: "dateRetracted", Value: time.Now()},
+		},
+	}})
+}
+
+func (db *Connection) updateBroadcastByID(id primitive.ObjectID, update bson.D) {
+	broadcastColl := db.Client.Database("tbstb").Collection("broadcasts")
+
+	_, err := broadcastColl.UpdateOne(context.Background(), bson.D{{Key: "_id", Value: id}}, update)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Move a broadcast from one status to another.
+// Returns false if the broadcast did not have the expected status, such as when it was already sent.
+func (db *Connection) UpdateBroadcastStatus(id primitive.ObjectID, from string, to string) bool {
+	broadcastColl := db.Client.Database("tbstb").Collection("broadcasts")
+
+	set := bson.D{{Key: "status", Value: to}}
+	if to == "sent" {
+		set = append(set, bson.E{Key: "dateSent", Value: time.Now()})
+	}
+
+	result, err := broadcastColl.UpdateOne(
+		context.Background(),
+		bson.D{
+			{Key: "_id", Value: id},
+			{Key: "status", Value: from},
+		},
+		bson.D{{Key: "$set", Value: set}},
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return result.ModifiedCount > 0
+}
+
+// Move a pending job to its next run, or to a new status once it will not run again.
+// Returns false if the job was changed or canceled since it was read.
+func (db *Connection) UpdateJobRun(job *Job, nextRun time.Time, status string) bool {
+	jobColl := db.Client.Database("tbstb").Collection("jobs")
+
+	result, err := jobColl.UpdateOne(
+		context.Background(),
+		bson.D{
+			{Key: "_id", Value: job.ID},
+			{Key: "status", Value: "pending"},
+			{Key: "nextRun", Value: job.NextRun},
+		},
+		bson.D{{
+			Key: "$set",
+			Value: bson.D{
+				{Key: "nextRun", Value: nextRun},
+				{Key: "status", Value: status},
+			},
+		}},
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return result.ModifiedCount > 0
+}
+
+// Cancel a pending job; returns false if it was not pending
+func (db *Connection) CancelJob(id primitive.ObjectID) bool {
+	jobColl := db.Client.Database("tbstb").Collection("jobs")
+
+	result, err := jobColl.UpdateOne(
+		context.Background(),
+		bson.D{
+			{Key: "_id", Value: id},
+			{Key: "status", Value: "pending"},
+		},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "status", Value: "canceled"}}}},
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return result.ModifiedCount > 0
+}
+
 func (db *Connection) UpdateRole(role *Role) {
 	roleColl := db.Client.Database("tbstb").Collection("roles")
 
@@ -577,6 +1911,57 @@ func (db *Connection) UpdateRole(role *Role) {
 	}
 }
 
+// Set the pseudonym of a role.
+// Returns ErrPseudonymTaken if another role already uses the pseudonym, ignoring case.
+func (db *Connection) SetPseudonym(id int64, pseudonym string) error {
+	roleColl := db.Client.Database("tbstb").Collection("roles")
+
+	_, err := roleColl.UpdateOne(
+		context.Background(),
+		bson.D{{Key: "_id", Value: id}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "pseudonym", Value: pseudonym}}}},
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrPseudonymTaken
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return nil
+}
+
+// Mark the user, and their role if they have one, as reachable or unreachable.
+// Returns true if this changed whether the user was reachable.
+func (db *Connection) SetUnreachable(id int64, unreachable bool) bool {
+	userColl := db.Client.Database("tbstb").Collection("users")
+	roleColl := db.Client.Database("tbstb").Collection("roles")
+
+	filter := bson.D{
+		{Key: "_id", Value: id},
+		{Key: "unreachable", Value: bson.D{{Key: "$ne", Value: unreachable}}},
+	}
+
+	var update bson.D
+	if unreachable {
+		update = bson.D{{Key: "$set", Value: bson.D{{Key: "unreachable", Value: true}}}}
+	} else {
+		update = bson.D{{Key: "$unset", Value: bson.D{{Key: "unreachable", Value: ""}}}}
+	}
+
+	userResult, err := userColl.UpdateOne(context.Background(), filter, update)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	roleResult, err := roleColl.UpdateOne(context.Background(), filter, update)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return userResult.ModifiedCount+roleResult.ModifiedCount > 0
+}
+
 func (db *Connection) DeleteRole(id int64) {
 	roleColl := db.Client.Database("tbstb").Collection("roles")
 
@@ -632,8 +2017,7 @@ func (db *Connection) HandleConfigError() *Config {
 }
 
 // Check if the required collections exist in the database.
-// If all or only some collections do not exist, create them.
-// Otherwise, ensure that the collections have the latest validation schema.
+// Create the ones that do not exist, and ensure that the others have the latest validation schema.
 func (db *Connection) CheckCollections() {
 	TBSTBDatabase := db.Client.Database("tbstb")
 
@@ -642,25 +2026,26 @@ func (db *Connection) CheckCollections() {
 		log.Fatal(listCollErr)
 	}
 
-	check := 0
+	db.ValidateSchema(currentCollections, TBSTBDatabase)
 
-	for _, collName := range currentCollections {
-		switch collName {
-		case "roles", "config", "tickets", "users":
-			check++
-		}
-	}
+	db.createIndexes(TBSTBDatabase)
+}
 
-	if check == 4 {
-		db.ValidateSchema(false, TBSTBDatabase)
-	} else {
-		db.ValidateSchema(true, TBSTBDatabase)
+// Create the indexes the collections rely on; creating an index that already exists does nothing
+func (db *Connection) createIndexes(database *mongo.Database) {
+	// Pseudonyms are unique regardless of case; roles without one are left out of the index
+	_, err := database.Collection("roles").Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "pseudonym", Value: 1}},
+		Options: options.Index().SetUnique(true).SetSparse(true).SetCollation(pseudonymCollation),
+	})
+	if err != nil {
+		log.Println(err)
 	}
 }
 
-// Creates the required collections if they do not exist
-// Otheriwse, updates the validation schema on the existing collections
-func (db *Connection) ValidateSchema(create bool, database *mongo.Database) {
+// Creates the required collections that are not among the existing ones,
+// and updates the validation schema on the existing collections
+func (db *Connection) ValidateSchema(existing []string, database *mongo.Database) {
 	rolesSchema := bson.M{
 		"bsonType": "object",
 		"title":    "Role Object Validation",
@@ -678,10 +2063,18 @@ func (db *Connection) ValidateSchema(create bool, database *mongo.Database) {
 				"bsonType":    "string",
 				"description": "The onymity of the user, either \"anon\", \"pseudonym\", or \"realname\"",
 			},
+			"pseudonym": bson.M{
+				"bsonType":    "string",
+				"description": "The name shown to users when the onymity is \"pseudonym\"",
+			},
 			"role": bson.M{
 				"bsonType":    "string",
 				"description": "The name of the role",
 			},
+			"unreachable": bson.M{
+				"bsonType":    "bool",
+				"description": "Whether the staff member has blocked the bot",
+			},
 		},
 	}
 
@@ -698,10 +2091,51 @@ func (db *Connection) ValidateSchema(create bool, database *mongo.Database) {
 				"bsonType":    "bool",
 				"description": "Toggle whether or not users can reopen issues themselves",
 			},
+			"reopenWindow": bson.M{
+				"bsonType":    "number",
+				"description": "How many days after a ticket is closed its creator can still reopen it; 0 for no limit, and unset for the default of 7",
+			},
 			"relayMedia": bson.M{
 				"bsonType":    "bool",
 				"description": "Toggle whether or not to relay media (photos, videos, etc)",
 			},
+			"mediaPolicies": bson.M{
+				"bsonType":    "array",
+				"description": "An array of restrictions on relaying each type of media",
+				"items": bson.M{
+					"bsonType": "object",
+					"required": []string{"type", "allowed"},
+					"properties": bson.M{
+						"type": bson.M{
+							"bsonType":    "string",
+							"description": "The type of media this policy applies to",
+						},
+						"allowed": bson.M{
+							"bsonType":    "bool",
+							"description": "Toggle whether or not to relay this type of media",
+						},
+						"maxSize": bson.M{
+							"bsonType":    "long",
+							"description": "The largest file size in bytes that will be relayed",
+						},
+						"blockedExtensions": bson.M{
+							"bsonType":    "array",
+							"description": "An array of file extensions that will not be relayed",
+							"items": bson.M{
+								"bsonType": "string",
+							},
+						},
+					},
+				},
+			},
+			"promptTitle": bson.M{
+				"bsonType":    "bool",
+				"description": "Toggle whether or not to ask users for a title when creating a ticket",
+			},
+			"ownerClaimed": bson.M{
+				"bsonType":    "bool",
+				"description": "Whether the first owner has been appointed, after which ownership can only be transferred",
+			},
 			"groups": bson.M{
 				"bsonType":    "array",
 				"description": "An array of groups that this bot belongs to",
@@ -709,6 +2143,33 @@ func (db *Connection) ValidateSchema(create bool, database *mongo.Database) {
 					"bsonType": "long",
 				},
 			},
+			"roles": bson.M{
+				"bsonType":    "array",
+				"description": "An array of custom roles, and changes to the default roles",
+				"items": bson.M{
+					"bsonType": "object",
+					"required": []string{"name", "rank", "permissions"},
+					"properties": bson.M{
+						"name": bson.M{
+							"bsonType":    "string",
+							"description": "The role type, as stored in the roles of staff members",
+						},
+						"rank": bson.M{
+							"bsonType":    "number",
+							"description": "The rank of this role; staff can only manage roles ranked below their own",
+						},
+						"permissions": bson.M{
+							"bsonType":    "array",
+							"description": "An array of actions staff with this role are allowed to take",
+							"items": bson.M{
+								"bsonType": "string",
+								"enum": []string{"close", "reopen", "assign", "broadcast", "manageRoles", "viewAllTickets", "deleteMessages", "ban", "manageGroups",
+									"editTickets", "viewStaff", "transferOwner"},
+							},
+						},
+					},
+				},
+			},
 		},
 	}
 
@@ -786,6 +2247,91 @@ func (db *Connection) ValidateSchema(create bool, database *mongo.Database) {
 							"bsonType":    "string",
 							"description": "A unique file id associated with the media in this message",
 						},
+						"mediaGroup": bson.M{
+							"bsonType":    "array",
+							"description": "An array of media items when this message is an album",
+							"items": bson.M{
+								"bsonType": "object",
+								"required": []string{"type", "fileID", "uniqueMediaID"},
+								"properties": bson.M{
+									"type": bson.M{
+										"bsonType":    "string",
+										"description": "The type of media, either \"photo\", \"video\", \"document\", or \"audio\"",
+									},
+									"fileID": bson.M{
+										"bsonType":    "string",
+										"description": "A file id associated with this media item",
+									},
+									"uniqueMediaID": bson.M{
+										"bsonType":    "string",
+										"description": "A unique file id associated with this media item",
+									},
+									"caption": bson.M{
+										"bsonType":    "string",
+										"description": "The caption associated with this media item",
+									},
+								},
+							},
+						},
+						"attachment": bson.M{
+							"bsonType":    "object",
+							"description": "Content without a file associated with this message",
+							"required":    []string{"type"},
+							"properties": bson.M{
+								"type": bson.M{
+									"bsonType":    "string",
+									"description": "The type of content, either \"location\", \"venue\", \"contact\", \"poll\", \"dice\", or \"story\"",
+								},
+							},
+						},
+						"edits": bson.M{
+							"bsonType":    "array",
+							"description": "An array of previous versions of this message",
+							"items": bson.M{
+								"bsonType": "object",
+								"required": []string{"dateEdited"},
+								"properties": bson.M{
+									"text": bson.M{
+										"bsonType":    "string",
+										"description": "The text or caption before the edit",
+									},
+									"dateEdited": bson.M{
+										"bsonType":    "date",
+										"description": "The date when this message was edited",
+									},
+								},
+							},
+						},
+						"failures": bson.M{
+							"bsonType":    "array",
+							"description": "An array of receivers this message could not be delivered to",
+							"items": bson.M{
+								"bsonType": "object",
+								"required": []string{"userID", "reason", "date"},
+								"properties": bson.M{
+									"userID": bson.M{
+										"bsonType":    "long",
+										"description": "The ID of the user who did not receive this message",
+									},
+									"reason": bson.M{
+										"bsonType":    "string",
+										"description": "The reason this message could not be delivered",
+									},
+									"date": bson.M{
+										"bsonType":    "date",
+										"description": "The date when delivery was given up",
+									},
+								},
+							},
+						},
+						"deletedBy": bson.M{
+							"bsonType":    "long",
+							"description": "The user who deleted this message",
+						},
+						"dateDeleted": bson.M{
+							"bsonType":    "date",
+							"description": "The date when this message was deleted",
+						},
 					},
 				},
 			},
@@ -797,6 +2343,32 @@ func (db *Connection) ValidateSchema(create bool, database *mongo.Database) {
 				"bsonType":    "date",
 				"description": "The date when this ticket was closed",
 			},
+			"titlePrompt": bson.M{
+				"bsonType":    "int",
+				"description": "Message ID of the prompt asking the creator for a title",
+			},
+			"category": bson.M{
+				"bsonType":    "string",
+				"description": "The category staff have filed this ticket under",
+			},
+			"topics": bson.M{
+				"bsonType":    "array",
+				"description": "An array of the topics of this ticket in forum groups",
+				"items": bson.M{
+					"bsonType": "object",
+					"required": []string{"chatID", "threadID"},
+					"properties": bson.M{
+						"chatID": bson.M{
+							"bsonType":    "long",
+							"description": "ID of the forum group",
+						},
+						"threadID": bson.M{
+							"bsonType":    "int",
+							"description": "ID of the topic in the forum group",
+						},
+					},
+				},
+			},
 		},
 	}
 
@@ -827,85 +2399,384 @@ func (db *Connection) ValidateSchema(create bool, database *mongo.Database) {
 			},
 			"canReopen": bson.M{
 				"bsonType":    "bool",
-				"description": "Whether the user can reopen tickets",
+				"description": "Whether the user can reopen tickets, if reopenOverride is set",
+			},
+			"reopenOverride": bson.M{
+				"bsonType":    "bool",
+				"description": "Whether staff chose if the user can reopen tickets; otherwise the default in the config applies",
 			},
 			"banned": bson.M{
 				"bsonType":    "bool",
 				"description": "Whether the user is banned and cannot interact with the bot",
 			},
+			"bannedUntil": bson.M{
+				"bsonType":    "date",
+				"description": "The date when a temporary ban ends",
+			},
+			"banReason": bson.M{
+				"bsonType":    "string",
+				"description": "The reason given for banning the user",
+			},
+			"unreachable": bson.M{
+				"bsonType":    "bool",
+				"description": "Whether the user has blocked the bot and can no longer receive messages",
+			},
+			"dateJoined": bson.M{
+				"bsonType":    "date",
+				"description": "The date when the user started the bot",
+			},
+			"language": bson.M{
+				"bsonType":    "string",
+				"description": "The language the user prefers to be answered in",
+			},
+			"disabledUpdates": bson.M{
+				"bsonType":    "bool",
+				"description": "Whether the user has disabled notifications when their tickets are closed or reopened",
+			},
 		},
 	}
 
-	if !create {
-		database.RunCommand(
-			context.Background(),
-			bson.D{
-				{Key: "collMod", Value: "roles"},
-				{Key: "validator", Value: bson.M{"$jsonSchema": rolesSchema}},
-				{Key: "validationLevel", Value: "moderate"},
-				{Key: "validationAction", Value: "warn"},
-			},
-		)
-		database.RunCommand(
-			context.Background(),
-			bson.D{
-				{Key: "collMod", Value: "config"},
-				{Key: "validator", Value: bson.M{"$jsonSchema": configSchema}},
-				{Key: "validationLevel", Value: "moderate"},
-				{Key: "validationAction", Value: "warn"},
-			},
-		)
-		database.RunCommand(
-			context.Background(),
-			bson.D{
-				{Key: "collMod", Value: "tickets"},
-				{Key: "validator", Value: bson.M{"$jsonSchema": ticketSchema}},
-				{Key: "validationLevel", Value: "moderate"},
-				{Key: "validationAction", Value: "warn"},
-			},
-		)
-		database.RunCommand(
-			context.Background(),
-			bson.D{
-				{Key: "collMod", Value: "users"},
-				{Key: "validator", Value: bson.M{"$jsonSchema": userSchema}},
-				{Key: "validationLevel", Value: "moderate"},
-				{Key: "validationAction", Value: "warn"},
-			},
-		)
-	} else {
-		rolesOpts := options.CreateCollection().SetValidator(bson.M{"$jsonSchema": rolesSchema})
-		configOpts := options.CreateCollection().SetValidator(bson.M{"$jsonSchema": configSchema})
-		ticketOpts := options.CreateCollection().SetValidator(bson.M{"$jsonSchema": ticketSchema})
-		userOpts := options.CreateCollection().SetValidator(bson.M{"$jsonSchema": userSchema})
-
-		rolesOpts.SetValidationLevel("moderate")
-		configOpts.SetValidationLevel("moderate")
-		ticketOpts.SetValidationLevel("moderate")
-		userOpts.SetValidationLevel("moderate")
-
-		rolesOpts.SetValidationAction("warn")
-		configOpts.SetValidationAction("warn")
-		ticketOpts.SetValidationAction("warn")
-		userOpts.SetValidationAction("warn")
-
-		createRolesErr := database.CreateCollection(context.Background(), "roles", rolesOpts)
-		if createRolesErr != nil {
-			log.Println(createRolesErr)
+	outboxSchema := bson.M{
+		"bsonType": "object",
+		"title":    "Outbox Object Validation",
+		"required": []string{"chatID", "params", "attempts", "nextAttempt", "status", "dateCreated"},
+		"properties": bson.M{
+			"chatID": bson.M{
+				"bsonType":    "long",
+				"description": "The chat this message is being delivered to",
+			},
+			"ticketID": bson.M{
+				"bsonType":    "string",
+				"description": "The ticket this message belongs to, if any",
+			},
+			"broadcastID": bson.M{
+				"bsonType":    "string",
+				"description": "The broadcast this message belongs to, if any",
+			},
+			"params": bson.M{
+				"bsonType":    "string",
+				"description": "The encoded parameters needed to send this message",
+			},
+			"attempts": bson.M{
+				"bsonType":    "int",
+				"description": "The number of times delivery has been attempted",
+			},
+			"nextAttempt": bson.M{
+				"bsonType":    "date",
+				"description": "The date when delivery will be attempted next",
+			},
+			"status": bson.M{
+				"bsonType":    "string",
+				"description": "The status of the delivery, either \"pending\" or \"failed\"",
+			},
+			"lastError": bson.M{
+				"bsonType":    "string",
+				"description": "The error returned by the last delivery attempt",
+			},
+			"dateCreated": bson.M{
+				"bsonType":    "date",
+				"description": "The date when this message was first queued",
+			},
+		},
+	}
+
+	broadcastSchema := bson.M{
+		"bsonType": "object",
+		"title":    "Broadcast Object Validation",
+		"required": []string{"author", "chatID", "originMSID", "params", "status", "dateCreated"},
+		"properties": bson.M{
+			"author": bson.M{
+				"bsonType":    "long",
+				"description": "The ID of the user who wrote this broadcast",
+			},
+			"chatID": bson.M{
+				"bsonType":    "long",
+				"description": "The chat where this broadcast was written",
+			},
+			"originMSID": bson.M{
+				"bsonType":    "int",
+				"description": "Message ID of the broadcast command",
+			},
+			"params": bson.M{
+				"bsonType":    "string",
+				"description": "The encoded parameters used to send this broadcast",
+			},
+			"status": bson.M{
+				"bsonType":    "string",
+				"description": "The status of this broadcast, either \"draft\", \"scheduled\", \"sent\", \"retracted\", or \"canceled\"",
+			},
+			"preview": bson.M{
+				"bsonType":    "array",
+				"description": "Message IDs of the preview shown to the author",
+				"items": bson.M{
+					"bsonType": "int",
+				},
+			},
+			"controlMSID": bson.M{
+				"bsonType":    "int",
+				"description": "Message ID of the message with the send and cancel buttons",
+			},
+			"schedule": bson.M{
+				"bsonType":    "object",
+				"description": "When this broadcast is sent, if it is scheduled",
+				"required":    []string{"at"},
+				"properties": bson.M{
+					"at": bson.M{
+						"bsonType":    "date",
+						"description": "The date when this broadcast is first sent",
+					},
+					"repeat": bson.M{
+						"bsonType":    "string",
+						"description": "How often this broadcast repeats, either \"daily\" or \"weekly\"",
+					},
+				},
+			},
+			"segment": bson.M{
+				"bsonType":    "object",
+				"description": "The users this broadcast is sent to, if not every user",
+				"required":    []string{"type"},
+				"properties": bson.M{
+					"type": bson.M{
+						"bsonType":    "string",
+						"description": "The type of segment, either \"open\", \"active\", \"joined\", \"category\", or \"staff\"",
+					},
+					"days": bson.M{
+						"bsonType":    "int",
+						"description": "For active users, the number of days to look back",
+					},
+					"date": bson.M{
+						"bsonType":    "date",
+						"description": "For users who joined, the date they joined after",
+					},
+					"category": bson.M{
+						"bsonType":    "string",
+						"description": "For ticket categories, the category of the tickets",
+					},
+				},
+			},
+			"templateID": bson.M{
+				"bsonType":    "objectId",
+				"description": "The repeating broadcast that this broadcast is a run of",
+			},
+			"recipients": bson.M{
+				"bsonType":    "int",
+				"description": "The number of users this broadcast was sent to",
+			},
+			"receivers": bson.M{
+				"bsonType":    "array",
+				"description": "An array of message IDs and their receivers",
+				"items": bson.M{
+					"bsonType": "object",
+					"required": []string{"msid", "userID"},
+					"properties": bson.M{
+						"msid": bson.M{
+							"bsonType":    "int",
+							"description": "Message ID associated with the user ID",
+						},
+						"userID": bson.M{
+							"bsonType":    "long",
+							"description": "The ID of the user who received this broadcast",
+						},
+					},
+				},
+			},
+			"failures": bson.M{
+				"bsonType":    "array",
+				"description": "An array of users this broadcast could not be delivered to",
+				"items": bson.M{
+					"bsonType": "object",
+					"required": []string{"userID", "reason", "date"},
+					"properties": bson.M{
+						"userID": bson.M{
+							"bsonType":    "long",
+							"description": "The ID of the user who did not receive this broadcast",
+						},
+						"reason": bson.M{
+							"bsonType":    "string",
+							"description": "The reason this broadcast could not be delivered",
+						},
+						"date": bson.M{
+							"bsonType":    "date",
+							"description": "The date when delivery was given up",
+						},
+					},
+				},
+			},
+			"dateCreated": bson.M{
+				"bsonType":    "date",
+				"description": "The date when this broadcast was created",
+			},
+			"dateSent": bson.M{
+				"bsonType":    "date",
+				"description": "The date when this broadcast was sent",
+			},
+			"dateEdited": bson.M{
+				"bsonType":    "date",
+				"description": "The date when the copies of this broadcast were last edited",
+			},
+			"dateRetracted": bson.M{
+				"bsonType":    "date",
+				"description": "The date when the copies of this broadcast were deleted",
+			},
+		},
+	}
+
+	jobSchema := bson.M{
+		"bsonType": "object",
+		"title":    "Job Object Validation",
+		"required": []string{"broadcastID", "author", "nextRun", "status", "dateCreated"},
+		"properties": bson.M{
+			"broadcastID": bson.M{
+				"bsonType":    "objectId",
+				"description": "The broadcast that this job sends",
+			},
+			"author": bson.M{
+				"bsonType":    "long",
+				"description": "The ID of the user who scheduled this job",
+			},
+			"nextRun": bson.M{
+				"bsonType":    "date",
+				"description": "The date when this job will run next",
+			},
+			"repeat": bson.M{
+				"bsonType":    "string",
+				"description": "How often this job repeats, either \"daily\" or \"weekly\"; empty if it runs once",
+			},
+			"status": bson.M{
+				"bsonType":    "string",
+				"description": "The status of this job, either \"pending\", \"done\", or \"canceled\"",
+			},
+			"dateCreated": bson.M{
+				"bsonType":    "date",
+				"description": "The date when this job was created",
+			},
+		},
+	}
+
+	schemas := []struct {
+		name   string
+		schema bson.M
+	}{
+		{"roles", rolesSchema},
+		{"config", configSchema},
+		{"tickets", ticketSchema},
+		{"users", userSchema},
+		{"outbox", outboxSchema},
+		{"broadcasts", broadcastSchema},
+		{"jobs", jobSchema},
+	}
+
+	for _, coll := range schemas {
+		if slices.Contains(existing, coll.name) {
+			err := database.RunCommand(
+				context.Background(),
+				bson.D{
+					{Key: "collMod", Value: coll.name},
+					{Key: "validator", Value: bson.M{"$jsonSchema": coll.schema}},
+					{Key: "validationLevel", Value: "moderate"},
+					{Key: "validationAction", Value: "warn"},
+				},
+			).Err()
+			if err != nil {
+				log.Println(err)
+			}
+			continue
+		}
+
+		opts := options.CreateCollection().SetValidator(bson.M{"$jsonSchema": coll.schema})
+		opts.SetValidationLevel("moderate")
+		opts.SetValidationAction("warn")
+
+		err := database.CreateCollection(context.Background(), coll.name, opts)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (config *Config) GetMediaPolicy(mediaType string) *MediaPolicy {
+	for i, policy := range config.MediaPolicies {
+		if policy.Type == mediaType {
+			return &config.MediaPolicies[i]
 		}
-		createConfigErr := database.CreateCollection(context.Background(), "config", configOpts)
-		if createConfigErr != nil {
-			log.Println(createConfigErr)
+	}
+
+	return nil
+}
+
+// Get the definition of a role type; custom roles take precedence over the default ones
+func (config *Config) GetRoleDefinition(roleType string) *RoleDefinition {
+	for i, role := range config.Roles {
+		if role.Name == roleType {
+			return &config.Roles[i]
 		}
-		createTicketsErr := database.CreateCollection(context.Background(), "tickets", ticketOpts)
-		if createTicketsErr != nil {
-			log.Println(createTicketsErr)
+	}
+
+	for i, role := range DefaultRoles {
+		if role.Name == roleType {
+			return &DefaultRoles[i]
 		}
-		createUsersErr := database.CreateCollection(context.Background(), "users", userOpts)
-		if createUsersErr != nil {
-			log.Println(createUsersErr)
+	}
+
+	return nil
+}
+
+// Get every role type, from the lowest rank to the highest
+func (config *Config) GetRoleDefinitions() []RoleDefinition {
+	roles := slices.Clone(config.Roles)
+	for _, role := range DefaultRoles {
+		if !slices.ContainsFunc(roles, func(custom RoleDefinition) bool { return custom.Name == role.Name }) {
+			roles = append(roles, role)
 		}
 	}
+
+	slices.SortStableFunc(roles, func(a RoleDefinition, b RoleDefinition) int {
+		return a.Rank - b.Rank
+	})
+
+	return roles
+}
+
+// Get the rank of a role type; unknown role types rank lowest
+func (config *Config) GetRank(roleType string) int {
+	role := config.GetRoleDefinition(roleType)
+	if role == nil {
+		return 0
+	}
+
+	return role.Rank
+}
+
+func (config *Config) HasPermission(roleType string, permission string) bool {
+	role := config.GetRoleDefinition(roleType)
+	if role == nil {
+		return false
+	}
+
+	return slices.Contains(role.Permissions, permission)
+}
+
+// Get how many days after a ticket is closed its creator can still reopen it, or 0 for no limit
+func (config *Config) GetReopenWindow() int {
+	if config.ReopenWindow == nil {
+		return DefaultReopenWindow
+	}
+
+	return *config.ReopenWindow
+}
+
+// Check whether the user can reopen their tickets, either as chosen by staff or by default
+func (user *User) MayReopen(config *Config) bool {
+	if user.ReopenOverride {
+		return user.CanReopen
+	}
+
+	return config.UserReopen
+}
+
+// Check whether the user is banned, taking into account when a temporary ban ends
+func (user *User) IsBanned() bool {
+	return user.Banned && (user.BannedUntil == nil || time.Now().Before(*user.BannedUntil))
 }
 
 func (message *Message) GetMessageReceivers() map[int64]int {
@@ -913,8 +2784,11 @@ func (message *Message) GetMessageReceivers() map[int64]int {
 
 	receivers[message.Sender] = message.OriginMSID
 
+	// Albums have several receivers per user; reply to the first message of each
 	for _, receiver := range message.Receivers {
-		receivers[receiver.UserID] = receiver.MSID
+		if _, ok := receivers[receiver.UserID]; !ok {
+			receivers[receiver.UserID] = receiver.MSID
+		}
 	}
 
 	return receivers
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+
+	database "github.com/Charibdys/tbstb/database"
+
+	"github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+// Match the service messages sent when a group is migrated to a supergroup
+func GroupMigrated() th.Predicate {
+	return func(update telego.Update) bool {
+		return update.Message != nil && (update.Message.MigrateToChatID != 0 || update.Message.MigrateFromChatID != 0)
+	}
+}
+
+// Unregister groups the bot has been removed from
+func groupMemberUpdated(bot *TBSTBBot, update *telego.ChatMemberUpdated, db *database.Connection) {
+	if update.Chat.Type != "group" && update.Chat.Type != "supergroup" {
+		return
+	}
+
+	switch update.NewChatMember.MemberStatus() {
+	case "left", "kicked":
+		if db.RemoveGroup(update.Chat.ID) {
+			notifyGroupManagers(bot, db, fmt.Sprintf("The bot was removed from <b>%s</b>, so the group has been unregistered.",
+				html.EscapeString(update.Chat.Title)))
+		}
+	}
+}
+
+// Follow a group to its new ID once it has been migrated to a supergroup.
+// Both the old group and the new supergroup get a service message, so this is handled once for whichever comes first.
+func migrateGroup(message *telego.Message, db *database.Connection) {
+	oldID, newID := message.Chat.ID, message.MigrateToChatID
+	if message.MigrateFromChatID != 0 {
+		oldID, newID = message.MigrateFromChatID, message.Chat.ID
+	}
+
+	db.ReplaceGroup(oldID, newID)
+}
+
+// Tell the staff who can manage groups about a change to them
+func notifyGroupManagers(bot *TBSTBBot, db *database.Connection, text string) {
+	config, err := db.GetConfig()
+	if err != nil {
+		return
+	}
+
+	for _, role := range db.GetAllRoles() {
+		if role.Unreachable || !config.HasPermission(role.RoleType, database.PermissionManageGroups) {
+			continue
+		}
+
+		_, _ = bot.SendMessage(&telego.SendMessageParams{
+			ChatID:    telego.ChatID{ID: role.ID},
+			Text:      text,
+			ParseMode: "HTML",
+		})
+	}
+}
+
+func groupsCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection) {
+	if update.Message.Chat.Type == "group" || update.Message.Chat.Type == "supergroup" {
+		return
+	}
+
+	role, allowed := authorize(db, update.Message.From.ID, database.PermissionManageGroups)
+	if !allowed {
+		return
+	}
+
+	text, markup := formatGroups(bot, db.DedupeGroups())
+
+	_, _ = bot.SendMessage(&telego.SendMessageParams{
+		ChatID:          telego.ChatID{ID: role.ID},
+		Text:            text,
+		ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+		ReplyMarkup:     markup,
+		ParseMode:       "HTML",
+	})
+}
+
+func formatGroups(bot *TBSTBBot, groups []int64) (string, *telego.InlineKeyboardMarkup) {
+	if len(groups) == 0 {
+		return "There are no registered groups.\n\nAdd the bot to a group you created to register it.", nil
+	}
+
+	text := "<b>Registered Groups</b>\n\n"
+
+	var rows [][]telego.InlineKeyboardButton
+	for i, id := range groups {
+		title := "<i>Unavailable</i>"
+		chat, err := bot.GetChat(&telego.GetChatParams{ChatID: telego.ChatID{ID: id}})
+		if err == nil {
+			title = html.EscapeString(chat.Title)
+		}
+
+		text += fmt.Sprintf("<b>%d.</b> %s (<code>%d</code>)\n", i+1, title, id)
+
+		rows = append(rows, tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(fmt.Sprintf("Unregister %d", i+1)).WithCallbackData(fmt.Sprintf("unregister_group=%d", id)),
+		))
+	}
+
+	return text, tu.InlineKeyboard(rows...)
+}
+
+func unregisterGroup(bot *TBSTBBot, query *telego.CallbackQuery, db *database.Connection) {
+	var query_msg *telego.Message
+
+	switch query.Message.(type) {
+	case *telego.InaccessibleMessage:
+		bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+			CallbackQueryID: query.ID,
+			Text:            "Could not access the query message.",
+			ShowAlert:       true,
+		})
+		return
+	case *telego.Message:
+		query_msg = query.Message.(*telego.Message)
+	}
+
+	if _, allowed := authorize(db, query.From.ID, database.PermissionManageGroups); !allowed {
+		bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+			CallbackQueryID: query.ID,
+			Text:            "You are not allowed to manage groups.",
+			ShowAlert:       true,
+		})
+		return
+	}
+
+	id, err := strconv.ParseInt(strings.Split(query.Data, "=")[1], 10, 64)
+	if err != nil {
+		bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{CallbackQueryID: query.ID})
+		return
+	}
+
+	answer := "This group was already unregistered."
+	if db.RemoveGroup(id) {
+		answer = "The group has been unregistered."
+	}
+
+	bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+		CallbackQueryID: query.ID,
+		Text:            answer,
+	})
+
+	text, markup := formatGroups(bot, db.GetGroupReceivers())
+
+	bot.EditMessageText(&telego.EditMessageTextParams{
+		ChatID:      telego.ChatID{ID: query.From.ID},
+		MessageID:   query_msg.MessageID,
+		Text:        text,
+		ReplyMarkup: markup,
+		ParseMode:   "HTML",
+	})
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mymmrac/telego"
+)
+
+// Telegram allows about 30 messages per second overall, one message per second in a private chat,
+// and 20 messages per minute in a group
+const (
+	globalRate   = 30
+	globalBurst  = 30
+	privateRate  = 1
+	privateBurst = 3
+	groupRate    = 20.0 / 60
+	groupBurst   = 5
+
+	// How long an unused per-chat bucket is kept
+	bucketRetention = 10 * time.Minute
+	// How often a low priority send checks whether the priority lane is clear
+	yieldInterval = 50 * time.Millisecond
+)
+
+type Priority int
+
+const (
+	PriorityHigh Priority = iota
+	PriorityLow
+)
+
+type bucket struct {
+	tokens   float64
+	rate     float64
+	burst    float64
+	lastFill time.Time
+}
+
+func newBucket(rate float64, burst float64) *bucket {
+	return &bucket{
+		tokens:   burst,
+		rate:     rate,
+		burst:    burst,
+		lastFill: time.Now(),
+	}
+}
+
+func (b *bucket) fill(now time.Time) {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.lastFill).Seconds()*b.rate)
+	b.lastFill = now
+}
+
+// Get how long until the bucket holds n tokens; requests larger than the bucket only wait for it to be full
+func (b *bucket) delay(n float64) time.Duration {
+	n = min(n, b.burst)
+	if b.tokens >= n {
+		return 0
+	}
+
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// RateLimiter spaces out outgoing messages with a global token bucket and one token bucket per chat.
+// High priority sends, such as ticket replies, go ahead of low priority ones, such as broadcasts.
+type RateLimiter struct {
+	mu          sync.Mutex
+	global      *bucket
+	chats       map[int64]*bucket
+	waitingHigh int
+	lastPurge   time.Time
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		global:    newBucket(globalRate, globalBurst),
+		chats:     make(map[int64]*bucket),
+		lastPurge: time.Now(),
+	}
+}
+
+// Wait blocks until n messages may be sent to the chat
+func (l *RateLimiter) Wait(chatID int64, n int, priority Priority) {
+	if priority == PriorityHigh {
+		l.mu.Lock()
+		l.waitingHigh++
+		l.mu.Unlock()
+
+		defer func() {
+			l.mu.Lock()
+			l.waitingHigh--
+			l.mu.Unlock()
+		}()
+	}
+
+	for {
+		l.mu.Lock()
+		if priority == PriorityLow && l.waitingHigh > 0 {
+			l.mu.Unlock()
+			time.Sleep(yieldInterval)
+			continue
+		}
+
+		now := time.Now()
+		l.purge(now)
+
+		chat, ok := l.chats[chatID]
+		if !ok {
+			if chatID < 0 {
+				chat = newBucket(groupRate, groupBurst)
+			} else {
+				chat = newBucket(privateRate, privateBurst)
+			}
+			l.chats[chatID] = chat
+		}
+
+		l.global.fill(now)
+		chat.fill(now)
+
+		wait := max(l.global.delay(float64(n)), chat.delay(float64(n)))
+		if wait == 0 {
+			l.global.tokens -= min(float64(n), l.global.burst)
+			chat.tokens -= min(float64(n), chat.burst)
+			l.mu.Unlock()
+			return
+		}
+		l.mu.Unlock()
+
+		if priority == PriorityLow {
+			wait = min(wait, yieldInterval)
+		}
+		time.Sleep(wait)
+	}
+}
+
+// Remove per-chat buckets that have not been used for a while.
+// The caller must hold the lock.
+func (l *RateLimiter) purge(now time.Time) {
+	if now.Sub(l.lastPurge) < bucketRetention {
+		return
+	}
+
+	for id, chat := range l.chats {
+		if now.Sub(chat.lastFill) > bucketRetention {
+			delete(l.chats, id)
+		}
+	}
+	l.lastPurge = now
+}
+
+// Bulk returns a copy of the bot whose sends use the low priority lane
+func (bot *TBSTBBot) Bulk() *TBSTBBot {
+	bulk := *bot
+	bulk.priority = PriorityLow
+
+	return &bulk
+}
+
+func (bot *TBSTBBot) wait(chatID telego.ChatID, n int) {
+	if bot.Limiter != nil {
+		bot.Limiter.Wait(chatID.ID, n, bot.priority)
+	}
+}
+
+// The methods below shadow those of telego.Bot so that every outgoing message goes through the rate limiter,
+// and messages for forum groups are sent into the topic of their ticket
+
+func (bot *TBSTBBot) SendMessage(params *telego.SendMessageParams) (*telego.Message, error) {
+	bot.wait(params.ChatID, 1)
+	params.MessageThreadID = bot.thread(params.ChatID, params.MessageThreadID)
+	return bot.Bot.SendMessage(params)
+}
+
+func (bot *TBSTBBot) SendAnimation(params *telego.SendAnimationParams) (*telego.Message, error) {
+	bot.wait(params.ChatID, 1)
+	params.MessageThreadID = bot.thread(params.ChatID, params.MessageThreadID)
+	return bot.Bot.SendAnimation(params)
+}
+
+func (bot *TBSTBBot) SendAudio(params *telego.SendAudioParams) (*telego.Message, error) {
+	bot.wait(params.ChatID, 1)
+	params.MessageThreadID = bot.thread(params.ChatID, params.MessageThreadID)
+	return bot.Bot.SendAudio(params)
+}
+
+func (bot *TBSTBBot) SendDocument(params *telego.SendDocumentParams) (*telego.Message, error) {
+	bot.wait(params.ChatID, 1)
+	params.MessageThreadID = bot.thread(params.ChatID, params.MessageThreadID)
+	return bot.Bot.SendDocument(params)
+}
+
+func (bot *TBSTBBot) SendPhoto(params *telego.SendPhotoParams) (*telego.Message, error) {
+	bot.wait(params.ChatID, 1)
+	params.MessageThreadID = bot.thread(params.ChatID, params.MessageThreadID)
+	return bot.Bot.SendPhoto(params)
+}
+
+func (bot *TBSTBBot) SendSticker(params *telego.SendStickerParams) (*telego.Message, error) {
+	bot.wait(params.ChatID, 1)
+	params.MessageThreadID = bot.thread(params.ChatID, params.MessageThreadID)
+	return bot.Bot.SendSticker(params)
+}
+
+func (bot *TBSTBBot) SendVideo(params *telego.SendVideoParams) (*telego.Message, error) {
+	bot.wait(params.ChatID, 1)
+	params.MessageThreadID = bot.thread(params.ChatID, params.MessageThreadID)
+	return bot.Bot.SendVideo(params)
+}
+
+func (bot *TBSTBBot) SendVideoNote(params *telego.SendVideoNoteParams) (*telego.Message, error) {
+	bot.wait(params.ChatID, 1)
+	params.MessageThreadID = bot.thread(params.ChatID, params.MessageThreadID)
+	return bot.Bot.SendVideoNote(params)
+}
+
+func (bot *TBSTBBot) SendVoice(params *telego.SendVoiceParams) (*telego.Message, error) {
+	bot.wait(params.ChatID, 1)
+	params.MessageThreadID = bot.thread(params.ChatID, params.MessageThreadID)
+	return bot.Bot.SendVoice(params)
+}
+
+func (bot *TBSTBBot) SendLocation(params *telego.SendLocationParams) (*telego.Message, error) {
+	bot.wait(params.ChatID, 1)
+	params.MessageThreadID = bot.thread(params.ChatID, params.MessageThreadID)
+	return bot.Bot.SendLocation(params)
+}
+
+func (bot *TBSTBBot) SendVenue(params *telego.SendVenueParams) (*telego.Message, error) {
+	bot.wait(params.ChatID, 1)
+	params.MessageThreadID = bot.thread(params.ChatID, params.MessageThreadID)
+	return bot.Bot.SendVenue(params)
+}
+
+func (bot *TBSTBBot) SendContact(params *telego.SendContactParams) (*telego.Message, error) {
+	bot.wait(params.ChatID, 1)
+	params.MessageThreadID = bot.thread(params.ChatID, params.MessageThreadID)
+	return bot.Bot.SendContact(params)
+}
+
+func (bot *TBSTBBot) SendPoll(params *telego.SendPollParams) (*telego.Message, error) {
+	bot.wait(params.ChatID, 1)
+	params.MessageThreadID = bot.thread(params.ChatID, params.MessageThreadID)
+	return bot.Bot.SendPoll(params)
+}
+
+func (bot *TBSTBBot) SendMediaGroup(params *telego.SendMediaGroupParams) ([]telego.Message, error) {
+	bot.wait(params.ChatID, len(params.Media))
+	params.MessageThreadID = bot.thread(params.ChatID, params.MessageThreadID)
+	return bot.Bot.SendMediaGroup(params)
+}
+
+func (bot *TBSTBBot) CopyMessage(params *telego.CopyMessageParams) (*telego.MessageID, error) {
+	bot.wait(params.ChatID, 1)
+	params.MessageThreadID = bot.thread(params.ChatID, params.MessageThreadID)
+	return bot.Bot.CopyMessage(params)
+}
+
+func (bot *TBSTBBot) ForwardMessage(params *telego.ForwardMessageParams) (*telego.Message, error) {
+	bot.wait(params.ChatID, 1)
+	params.MessageThreadID = bot.thread(params.ChatID, params.MessageThreadID)
+	return bot.Bot.ForwardMessage(params)
+}
+
+func (bot *TBSTBBot) EditMessageText(params *telego.EditMessageTextParams) (*telego.Message, error) {
+	bot.wait(params.ChatID, 1)
+	return bot.Bot.EditMessageText(params)
+}
+
+func (bot *TBSTBBot) EditMessageCaption(params *telego.EditMessageCaptionParams) (*telego.Message, error) {
+	bot.wait(params.ChatID, 1)
+	return bot.Bot.EditMessageCaption(params)
+}
+
+func (bot *TBSTBBot) DeleteMessage(params *telego.DeleteMessageParams) error {
+	bot.wait(params.ChatID, 1)
+	return bot.Bot.DeleteMessage(params)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"time"
+
+	database "github.com/Charibdys/tbstb/database"
+
+	"github.com/mymmrac/telego"
+	ta "github.com/mymmrac/telego/telegoapi"
+)
+
+const (
+	outboxInterval    = time.Second
+	outboxMaxAttempts = 8
+	outboxBaseDelay   = 5 * time.Second
+	outboxMaxDelay    = time.Hour
+)
+
+// The parameters needed to relay a message to a single receiver, as stored in the database
+type storedRelay struct {
+	Text         string                 `json:"text"`
+	Media        *string                `json:"media,omitempty"`
+	Entities     []telego.MessageEntity `json:"entities,omitempty"`
+	Reply        int                    `json:"reply,omitempty"`
+	ParseMode    string                 `json:"parse_mode,omitempty"`
+	Message      *telego.Message        `json:"message,omitempty"`
+	Album        []telego.Message       `json:"album,omitempty"`
+	Attachment   *database.Attachment   `json:"attachment,omitempty"`
+	Continuation []string               `json:"continuation,omitempty"`
+}
+
+// Outbox keeps messages that could not be delivered and retries them with backoff.
+// Messages that can never be delivered are recorded on their ticket.
+type Outbox struct {
+	db *database.Connection
+}
+
+func NewOutbox(db *database.Connection) *Outbox {
+	return &Outbox{db: db}
+}
+
+// Queue a failed relay for another attempt, or record it as undeliverable if the error is permanent
+func (o *Outbox) HandleFailure(bot *TBSTBBot, chatID int64, params *RelayParams, err error) {
+	delay, retryable := classifyError(err, 1)
+	if !retryable {
+		o.recordFailure(bot, chatID, params, err)
+		return
+	}
+
+	encoded, encodeErr := encodeRelay(params, params.Reply[chatID])
+	if encodeErr != nil {
+		fmt.Printf("%s\n", encodeErr)
+		return
+	}
+
+	o.db.CreateOutboxItem(chatID, params.TicketID, params.BroadcastID, encoded, err.Error(), time.Now().Add(delay))
+}
+
+// Periodically retry queued messages that are due
+func (o *Outbox) Run(bot *TBSTBBot) {
+	for {
+		for _, item := range o.db.GetDueOutboxItems() {
+			o.retry(bot, &item)
+		}
+
+		time.Sleep(outboxInterval)
+	}
+}
+
+func (o *Outbox) retry(bot *TBSTBBot, item *database.OutboxItem) {
+	params, reply, err := decodeRelay(item.Params)
+	if err != nil {
+		item.Status = "failed"
+		item.LastError = err.Error()
+		o.db.UpdateOutboxItem(item)
+		return
+	}
+	params.Reply = map[int64]int{item.ChatID: reply}
+	params.TicketID = item.TicketID
+	params.BroadcastID = item.BroadcastID
+
+	// Retried ticket messages still belong in the ticket's topic
+	if item.TicketID != "" {
+		if ticket, err := o.db.GetTicket(item.TicketID); err == nil {
+			bot = bot.InTopics(ticketTopics(o.db, ticket))
+		}
+	}
+
+	msgs, err := relay(item.ChatID, params, bot)
+	if err == nil {
+		o.db.DeleteOutboxItem(item.ID)
+
+		var receivers []database.Receiver
+		for _, msg := range msgs {
+			receivers = append(receivers, database.Receiver{
+				MSID:   msg.MessageID,
+				UserID: item.ChatID,
+			})
+		}
+
+		if item.BroadcastID != "" {
+			o.db.AppendBroadcastReceivers(item.BroadcastID, receivers)
+
+			// The broadcast may have been deleted while this copy was being sent
+			if o.db.GetBroadcastStatus(item.BroadcastID) == "retracted" {
+				deleteCopies(bot, receivers)
+			}
+		} else if item.TicketID != "" && params.Message != nil && params.Message.From != nil {
+			o.db.AppendReceivers(item.TicketID, params.Message.From.ID, params.Message.MessageID, receivers)
+		}
+		return
+	}
+
+	item.Attempts++
+	item.LastError = err.Error()
+
+	delay, retryable := classifyError(err, item.Attempts)
+	if retryable && item.Attempts < outboxMaxAttempts {
+		item.NextAttempt = time.Now().Add(delay)
+		o.db.UpdateOutboxItem(item)
+		return
+	}
+
+	item.Status = "failed"
+	o.db.UpdateOutboxItem(item)
+
+	o.recordFailure(bot, item.ChatID, params, err)
+}
+
+// Record an undeliverable message on its ticket or broadcast.
+// If a reply could not reach the ticket creator, the sender is told.
+func (o *Outbox) recordFailure(bot *TBSTBBot, chatID int64, params *RelayParams, err error) {
+	if chatID > 0 && isBlocked(err) {
+		markUnreachable(bot, o.db, chatID)
+	}
+	if chatID < 0 {
+		o.forgetGroup(bot, chatID, err)
+	}
+
+	reason := err.Error()
+	var apiErr *ta.Error
+	if errors.As(err, &apiErr) {
+		reason = apiErr.Description
+	}
+
+	failure := &database.Failure{
+		UserID: chatID,
+		Reason: reason,
+		Date:   time.Now(),
+	}
+
+	if params.BroadcastID != "" {
+		o.db.AppendBroadcastFailure(params.BroadcastID, failure)
+		return
+	}
+
+	if params.TicketID == "" || params.Message == nil || params.Message.From == nil {
+		return
+	}
+
+	sender := params.Message.From.ID
+
+	o.db.AppendFailure(params.TicketID, sender, params.Message.MessageID, failure)
+
+	ticket, ticketErr := o.db.GetTicket(params.TicketID)
+	if ticketErr != nil || chatID != ticket.Creator || sender == ticket.Creator {
+		return
+	}
+
+	_, _ = bot.SendMessage(&telego.SendMessageParams{
+		ChatID: telego.ChatID{ID: params.Message.Chat.ID},
+		Text: fmt.Sprintf("Your message to ticket <code>%s</code> could not be delivered to the ticket creator.\n"+
+			"<b>Reason:</b> %s", params.TicketID[len(params.TicketID)-7:], html.EscapeString(reason)),
+		ReplyParameters: &telego.ReplyParameters{MessageID: params.Message.MessageID},
+		ParseMode:       "HTML",
+	})
+}
+
+// Encode the parameters of a relay, replying to the given message, for storage in the database
+func encodeRelay(params *RelayParams, reply int) (string, error) {
+	encoded, err := json.Marshal(&storedRelay{
+		Text:         params.Text,
+		Media:        params.Media,
+		Entities:     params.Entities,
+		Reply:        reply,
+		ParseMode:    params.ParseMode,
+		Message:      trimMessage(params.Message),
+		Album:        trimAlbum(params.Album),
+		Attachment:   params.Attachment,
+		Continuation: params.Continuation,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return string(encoded), nil
+}
+
+// Decode stored relay parameters; the receivers and ticket are not stored, and the reply is returned separately
+func decodeRelay(data string) (*RelayParams, int, error) {
+	var stored storedRelay
+	if err := json.Unmarshal([]byte(data), &stored); err != nil {
+		return nil, 0, err
+	}
+
+	return &RelayParams{
+		Text:         stored.Text,
+		Media:        stored.Media,
+		Entities:     stored.Entities,
+		ParseMode:    stored.ParseMode,
+		Message:      stored.Message,
+		Album:        stored.Album,
+		Attachment:   stored.Attachment,
+		Continuation: stored.Continuation,
+	}, stored.Reply, nil
+}
+
+// Determine whether a failed request should be retried, and how long to wait before the given attempt.
+// Flood control errors are retried after the wait Telegram asks for; server and network errors are retried
+// with exponential backoff; any other error from Telegram, such as a blocked bot or a deleted chat, is permanent.
+func classifyError(err error, attempt int) (time.Duration, bool) {
+	delay := min(outboxBaseDelay<<(attempt-1), outboxMaxDelay)
+
+	var apiErr *ta.Error
+	if !errors.As(err, &apiErr) {
+		return delay, true
+	}
+
+	switch {
+	case apiErr.ErrorCode == 429:
+		if apiErr.Parameters != nil && apiErr.Parameters.RetryAfter > 0 {
+			return time.Duration(apiErr.Parameters.RetryAfter) * time.Second, true
+		}
+		return delay, true
+	case apiErr.ErrorCode >= 500:
+		return delay, true
+	}
+
+	return 0, false
+}
+
+// Unregister a group the bot can no longer send to, or follow it to its new ID if it became a supergroup
+func (o *Outbox) forgetGroup(bot *TBSTBBot, chatID int64, err error) {
+	var apiErr *ta.Error
+	if !errors.As(err, &apiErr) {
+		return
+	}
+
+	if apiErr.Parameters != nil && apiErr.Parameters.MigrateToChatID != 0 {
+		o.db.ReplaceGroup(chatID, apiErr.Parameters.MigrateToChatID)
+	} else if apiErr.ErrorCode == 403 && o.db.RemoveGroup(chatID) {
+		notifyGroupManagers(bot, o.db, fmt.Sprintf("The bot can no longer send messages to the group <code>%d</code>, so it has been unregistered.", chatID))
+	}
+}
+
+// Check whether Telegram refused a request because the user blocked the bot or deleted their account
+func isBlocked(err error) bool {
+	var apiErr *ta.Error
+	return errors.As(err, &apiErr) && apiErr.ErrorCode == 403
+}
+
+// Keep only the parts of a message needed to relay it again
+func trimMessage(message *telego.Message) *telego.Message {
+	if message == nil {
+		return nil
+	}
+
+	return &telego.Message{
+		MessageID:       message.MessageID,
+		From:            message.From,
+		Date:            message.Date,
+		Chat:            message.Chat,
+		MediaGroupID:    message.MediaGroupID,
+		Text:            message.Text,
+		Entities:        message.Entities,
+		Animation:       message.Animation,
+		Audio:           message.Audio,
+		Document:        message.Document,
+		Photo:           message.Photo,
+		Sticker:         message.Sticker,
+		Story:           message.Story,
+		Video:           message.Video,
+		VideoNote:       message.VideoNote,
+		Voice:           message.Voice,
+		Caption:         message.Caption,
+		CaptionEntities: message.CaptionEntities,
+	}
+}
+
+func trimAlbum(album []telego.Message) []telego.Message {
+	var trimmed []telego.Message
+	for i := range album {
+		trimmed = append(trimmed, *trimMessage(&album[i]))
+	}
+
+	return trimmed
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+
+	database "github.com/Charibdys/tbstb/database"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+// Make the user an owner if the /start payload matches the setup secret, unless the bot already has an owner.
+// Returns true if the payload was the secret, in which case the message has been handled.
+func claimOwner(bot *TBSTBBot, update *telego.Update, db *database.Connection, config *database.Config, setupSecret string) bool {
+	_, payload, _ := strings.Cut(update.Message.Text, " ")
+	payload = strings.TrimSpace(payload)
+
+	if setupSecret == "" || subtle.ConstantTimeCompare([]byte(payload), []byte(setupSecret)) != 1 {
+		return false
+	}
+
+	// Keep the secret out of the chat history
+	_ = bot.DeleteMessage(&telego.DeleteMessageParams{
+		ChatID:    telego.ChatID{ID: update.Message.Chat.ID},
+		MessageID: update.Message.MessageID,
+	})
+
+	userID := update.Message.From.ID
+
+	// The secret only appoints the first owner; after that, ownership can only be transferred
+	if !db.ClaimOwnership() {
+		_, _ = bot.SendMessage(&telego.SendMessageParams{
+			ChatID:    telego.ChatID{ID: userID},
+			Text:      "This bot already has an owner. Ownership can only be transferred with /transfer_owner.",
+			ParseMode: "HTML",
+		})
+		return true
+	}
+
+	name := update.Message.From.FirstName
+	if update.Message.From.LastName != "" {
+		name = name + " " + update.Message.From.LastName
+	}
+
+	if _, err := db.GetUser(userID); err != nil {
+		db.CreateUser(userID, update.Message.From.Username, name, config)
+	}
+
+	role, err := db.GetRole(userID)
+	if err != nil {
+		db.CreateRole(userID, name, "owner", config)
+	} else {
+		role.RoleType = "owner"
+		db.UpdateRole(role)
+	}
+
+	_, _ = bot.SendMessage(&telego.SendMessageParams{
+		ChatID:    telego.ChatID{ID: userID},
+		Text:      fmt.Sprintf("Welcome, %s! You have been authorized as owner", html.EscapeString(name)),
+		ParseMode: "HTML",
+	})
+
+	return true
+}
+
+func transferOwnerCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection) {
+	if update.Message.Chat.Type == "group" || update.Message.Chat.Type == "supergroup" {
+		return
+	}
+
+	role, allowed := authorize(db, update.Message.From.ID, database.PermissionTransferOwner)
+	if !allowed {
+		return
+	}
+
+	target, _, reason := resolveTarget(bot, update.Message, strings.Fields(update.Message.Text)[1:], db)
+
+	if target != nil {
+		if targetRole, _ := db.GetRole(target.ID); targetRole != nil && targetRole.RoleType == "owner" {
+			reason = "This user is already an owner."
+			target = nil
+		}
+	}
+
+	if target == nil {
+		_, _ = bot.SendMessage(&telego.SendMessageParams{
+			ChatID:          telego.ChatID{ID: role.ID},
+			Text:            reason,
+			ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+			ParseMode:       "HTML",
+		})
+		return
+	}
+
+	markup := tu.InlineKeyboard(
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("Transfer").WithCallbackData(fmt.Sprintf("transfer_owner=%d", target.ID)),
+			tu.InlineKeyboardButton("Cancel").WithCallbackData("cancel_transfer_owner"),
+		),
+	)
+
+	_, _ = bot.SendMessage(&telego.SendMessageParams{
+		ChatID: telego.ChatID{ID: role.ID},
+		Text: fmt.Sprintf("Are you sure you want to transfer ownership to <b>%s</b> (<code>%d</code>)?\n\n"+
+			"They will become an owner, and you will become an admin. This cannot be undone by you.",
+			html.EscapeString(target.Fullname), target.ID),
+		ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+		ReplyMarkup:     markup,
+		ParseMode:       "HTML",
+	})
+}
+
+func transferOwner(bot *TBSTBBot, query *telego.CallbackQuery, db *database.Connection) {
+	var query_msg *telego.Message
+
+	switch query.Message.(type) {
+	case *telego.InaccessibleMessage:
+		bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+			CallbackQueryID: query.ID,
+			Text:            "Could not access the query message.",
+			ShowAlert:       true,
+		})
+		return
+	case *telego.Message:
+		query_msg = query.Message.(*telego.Message)
+	}
+
+	role, allowed := authorize(db, query.From.ID, database.PermissionTransferOwner)
+	if !allowed {
+		bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+			CallbackQueryID: query.ID,
+			Text:            "You are not allowed to transfer ownership.",
+			ShowAlert:       true,
+		})
+		return
+	}
+	config, err := db.GetConfig()
+	if err != nil {
+		bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{CallbackQueryID: query.ID})
+		return
+	}
+
+	targetID, err := strconv.ParseInt(strings.Split(query.Data, "=")[1], 10, 64)
+	if err != nil || targetID == role.ID {
+		bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{CallbackQueryID: query.ID})
+		return
+	}
+
+	target, err := db.GetUser(targetID)
+	if err != nil {
+		bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+			CallbackQueryID: query.ID,
+			Text:            "This user does not exist.",
+			ShowAlert:       true,
+		})
+		return
+	}
+
+	targetRole, err := db.GetRole(target.ID)
+	if err != nil {
+		db.CreateRole(target.ID, target.Fullname, "owner", config)
+	} else {
+		targetRole.RoleType = "owner"
+		db.UpdateRole(targetRole)
+	}
+
+	role.RoleType = "admin"
+	db.UpdateRole(role)
+
+	bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+		CallbackQueryID: query.ID,
+	})
+
+	bot.EditMessageText(&telego.EditMessageTextParams{
+		ChatID:      telego.ChatID{ID: role.ID},
+		MessageID:   query_msg.MessageID,
+		Text:        fmt.Sprintf("Ownership has been transferred to <b>%s</b>. You are now an admin.", html.EscapeString(target.Fullname)),
+		ParseMode:   "HTML",
+		ReplyMarkup: nil,
+	})
+
+	_, _ = bot.SendMessage(&telego.SendMessageParams{
+		ChatID:    telego.ChatID{ID: target.ID},
+		Text:      "Ownership of this bot has been transferred to you. You are now an owner.",
+		ParseMode: "HTML",
+	})
+}
+
+func cancelTransferOwner(bot *TBSTBBot, query *telego.CallbackQuery) {
+	var query_msg *telego.Message
+
+	switch query.Message.(type) {
+	case *telego.InaccessibleMessage:
+		bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+			CallbackQueryID: query.ID,
+			Text:            "Could not access the query message.",
+			ShowAlert:       true,
+		})
+		return
+	case *telego.Message:
+		query_msg = query.Message.(*telego.Message)
+	}
+
+	bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+		CallbackQueryID: query.ID,
+	})
+
+	bot.EditMessageText(&telego.EditMessageTextParams{
+		ChatID:      telego.ChatID{ID: query.From.ID},
+		MessageID:   query_msg.MessageID,
+		Text:        "The ownership transfer has been canceled.",
+		ParseMode:   "HTML",
+		ReplyMarkup: nil,
+	})
+}
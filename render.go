@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"slices"
+	"unicode/utf16"
+
+	"github.com/mymmrac/telego"
+)
+
+// Telegram limits on the length of text after entities have been parsed
+const (
+	textLimit    = 4096
+	captionLimit = 1024
+)
+
+var tagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// Add a header to the text or caption of a message, splitting the text if the result is too long to send at once.
+// Returns the text of the message itself, and the text of any continuation messages.
+// A caption that is too long is moved entirely to the continuation messages.
+func formatRelayText(message *telego.Message, header string, caption bool) (string, []string) {
+	text, entities := message.Text, message.Entities
+	if text == "" {
+		text, entities = message.Caption, message.CaptionEntities
+	}
+
+	limit := textLimit
+	if caption {
+		limit = captionLimit
+	}
+
+	reserved := visibleLength(header)
+	if len(utf16.Encode([]rune(text)))+reserved <= limit {
+		return header + renderHTML(text, entities), nil
+	}
+
+	if caption {
+		return header, splitHTML(text, entities, textLimit, textLimit)
+	}
+
+	parts := splitHTML(text, entities, textLimit-reserved, textLimit)
+
+	return header + parts[0], parts[1:]
+}
+
+// Split text into parts of at most first and then rest UTF-16 code units, preferably at line breaks or spaces,
+// and render each part as HTML
+func splitHTML(text string, entities []telego.MessageEntity, first int, rest int) []string {
+	units := utf16.Encode([]rune(text))
+
+	var parts []string
+	start := 0
+	size := first
+	for start < len(units) {
+		end := start + size
+		if end >= len(units) {
+			end = len(units)
+		} else {
+			// Avoid splitting a surrogate pair
+			if utf16.IsSurrogate(rune(units[end-1])) && units[end-1] < 0xDC00 {
+				end--
+			}
+
+			if i := lastIndex(units[start+size/2:end], '\n'); i >= 0 {
+				end = start + size/2 + i + 1
+			} else if i := lastIndex(units[start+size/2:end], ' '); i >= 0 {
+				end = start + size/2 + i + 1
+			}
+		}
+
+		var partEntities []telego.MessageEntity
+		for _, entity := range entities {
+			entityStart := max(entity.Offset, start)
+			entityEnd := min(entity.Offset+entity.Length, end)
+			if entityStart >= entityEnd {
+				continue
+			}
+
+			entity.Offset = entityStart - start
+			entity.Length = entityEnd - entityStart
+			partEntities = append(partEntities, entity)
+		}
+
+		parts = append(parts, renderHTML(string(utf16.Decode(units[start:end])), partEntities))
+
+		start = end
+		size = rest
+	}
+
+	return parts
+}
+
+func lastIndex(units []uint16, unit uint16) int {
+	for i := len(units) - 1; i >= 0; i-- {
+		if units[i] == unit {
+			return i
+		}
+	}
+	return -1
+}
+
+// Get the length of HTML text as counted by Telegram, in UTF-16 code units
+func visibleLength(text string) int {
+	return len(utf16.Encode([]rune(html.UnescapeString(tagPattern.ReplaceAllString(text, "")))))
+}
+
+// Escape text for the HTML parse mode and convert its entities to HTML tags.
+// Entity offsets and lengths are measured in UTF-16 code units.
+func renderHTML(text string, entities []telego.MessageEntity) string {
+	units := utf16.Encode([]rune(text))
+
+	var tagged []telego.MessageEntity
+	for _, entity := range entities {
+		if _, ok := entityTag(&entity); ok && entity.Length > 0 {
+			tagged = append(tagged, entity)
+		}
+	}
+
+	// Outer entities open before inner ones that start at the same offset
+	slices.SortStableFunc(tagged, func(a, b telego.MessageEntity) int {
+		if a.Offset != b.Offset {
+			return a.Offset - b.Offset
+		}
+		return b.Length - a.Length
+	})
+
+	var result string
+	var open []telego.MessageEntity
+	next := 0
+	position := 0
+
+	for position <= len(units) {
+		// Close entities that end here; entities opened after them are closed and reopened
+		for i := len(open) - 1; i >= 0; i-- {
+			if open[i].Offset+open[i].Length > position {
+				continue
+			}
+
+			for j := len(open) - 1; j >= i; j-- {
+				result += closingTag(&open[j])
+			}
+			reopen := slices.Clone(open[i+1:])
+			open = append(open[:i], reopen...)
+			for j := range reopen {
+				result += openingTag(&reopen[j])
+			}
+		}
+
+		for next < len(tagged) && tagged[next].Offset <= position {
+			result += openingTag(&tagged[next])
+			open = append(open, tagged[next])
+			next++
+		}
+
+		if position == len(units) {
+			break
+		}
+
+		// Copy text up to the next entity boundary
+		end := len(units)
+		if next < len(tagged) && tagged[next].Offset < end {
+			end = tagged[next].Offset
+		}
+		for _, entity := range open {
+			if entity.Offset+entity.Length < end {
+				end = entity.Offset + entity.Length
+			}
+		}
+		if end <= position {
+			end = position + 1
+		}
+
+		result += html.EscapeString(string(utf16.Decode(units[position:end])))
+		position = end
+	}
+
+	for i := len(open) - 1; i >= 0; i-- {
+		result += closingTag(&open[i])
+	}
+
+	return result
+}
+
+// Get the HTML tag name for an entity; entities that Telegram detects on its own have none
+func entityTag(entity *telego.MessageEntity) (string, bool) {
+	switch entity.Type {
+	case telego.EntityTypeBold:
+		return "b", true
+	case telego.EntityTypeItalic:
+		return "i", true
+	case telego.EntityTypeUnderline:
+		return "u", true
+	case telego.EntityTypeStrikethrough:
+		return "s", true
+	case telego.EntityTypeSpoiler:
+		return "tg-spoiler", true
+	case telego.EntityTypeCode:
+		return "code", true
+	case telego.EntityTypePre:
+		return "pre", true
+	case telego.EntityTypeTextLink, telego.EntityTypeTextMention:
+		return "a", true
+	case telego.EntityTypeCustomEmoji:
+		return "tg-emoji", true
+	case telego.EntityTypeBlockquote, telego.EntityTypeExpandableBlockquote:
+		return "blockquote", true
+	}
+	return "", false
+}
+
+func openingTag(entity *telego.MessageEntity) string {
+	tag, _ := entityTag(entity)
+
+	switch entity.Type {
+	case telego.EntityTypePre:
+		if entity.Language != "" {
+			return fmt.Sprintf("<pre><code class=\"language-%s\">", html.EscapeString(entity.Language))
+		}
+	case telego.EntityTypeTextLink:
+		return fmt.Sprintf("<a href=\"%s\">", html.EscapeString(entity.URL))
+	case telego.EntityTypeTextMention:
+		if entity.User != nil {
+			return fmt.Sprintf("<a href=\"tg://user?id=%d\">", entity.User.ID)
+		}
+	case telego.EntityTypeCustomEmoji:
+		return fmt.Sprintf("<tg-emoji emoji-id=\"%s\">", html.EscapeString(entity.CustomEmojiID))
+	case telego.EntityTypeExpandableBlockquote:
+		return "<blockquote expandable>"
+	}
+
+	return fmt.Sprintf("<%s>", tag)
+}
+
+func closingTag(entity *telego.MessageEntity) string {
+	tag, _ := entityTag(entity)
+
+	if entity.Type == telego.EntityTypePre && entity.Language != "" {
+		return "</code></pre>"
+	}
+
+	return fmt.Sprintf("</%s>", tag)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	database "github.com/Charibdys/tbstb/database"
+
+	"github.com/mymmrac/telego"
+)
+
+const schedulerInterval = 10 * time.Second
+
+// Scheduler sends scheduled broadcasts once they are due.
+// Jobs are kept in the database, so runs missed while the bot was down are sent when it starts again.
+type Scheduler struct {
+	db *database.Connection
+}
+
+func NewScheduler(db *database.Connection) *Scheduler {
+	return &Scheduler{db: db}
+}
+
+// Periodically run jobs that are due
+func (s *Scheduler) Run(bot *TBSTBBot) {
+	for {
+		for _, job := range s.db.GetDueJobs() {
+			s.run(bot, &job)
+		}
+
+		time.Sleep(schedulerInterval)
+	}
+}
+
+func (s *Scheduler) run(bot *TBSTBBot, job *database.Job) {
+	broadcast, err := s.db.GetBroadcast(job.BroadcastID.Hex())
+	if err != nil {
+		s.db.UpdateJobRun(job, job.NextRun, "done")
+		return
+	}
+
+	// Claim the run before sending, so it is not sent twice; missed runs of a repeating job are skipped
+	status := "done"
+	next := job.NextRun
+	if job.Repeat != "" {
+		status = "pending"
+		next = nextRun(job.NextRun, job.Repeat, time.Now())
+	}
+	if !s.db.UpdateJobRun(job, next, status) {
+		return
+	}
+
+	// A one-off broadcast is sent as it is; each run of a repeating broadcast gets its own delivery report
+	sent := broadcast
+	if job.Repeat == "" {
+		s.db.UpdateBroadcastStatus(broadcast.ID, "scheduled", "sent")
+	} else {
+		sent = s.db.CreateBroadcastRun(broadcast)
+	}
+
+	reached := deliverBroadcast(bot, s.db, sent)
+
+	id := sent.ID.Hex()
+	text := fmt.Sprintf("Sent scheduled broadcast <code>%s</code> to %d users.", id[len(id)-7:], reached)
+	if job.Repeat != "" {
+		text += fmt.Sprintf("\nThe next run is at %s.", next.Local().Format("2006-01-02 15:04 MST"))
+	}
+
+	_, _ = bot.SendMessage(&telego.SendMessageParams{
+		ChatID:          telego.ChatID{ID: broadcast.ChatID},
+		Text:            text,
+		ReplyParameters: &telego.ReplyParameters{MessageID: broadcast.OriginMSID, AllowSendingWithoutReply: true},
+		ParseMode:       "HTML",
+	})
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	database "github.com/Charibdys/tbstb/database"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+// Languages users can choose from, by IETF language tag
+var languages = []struct {
+	Tag  string
+	Name string
+}{
+	{"en", "English"},
+	{"es", "Español"},
+	{"fr", "Français"},
+	{"de", "Deutsch"},
+	{"it", "Italiano"},
+	{"pt", "Português"},
+	{"ru", "Русский"},
+	{"uk", "Українська"},
+}
+
+func languageName(tag string) string {
+	for _, language := range languages {
+		if language.Tag == tag {
+			return language.Name
+		}
+	}
+
+	return "Not set"
+}
+
+func isLanguage(tag string) bool {
+	for _, language := range languages {
+		if language.Tag == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+func onOff(value bool) string {
+	if value {
+		return "On"
+	}
+	return "Off"
+}
+
+func settingsCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection) {
+	if update.Message.Chat.Type == "group" || update.Message.Chat.Type == "supergroup" {
+		return
+	}
+
+	user, err := db.GetUser(update.Message.From.ID)
+	if err != nil {
+		noUser(bot, update.Message)
+		return
+	}
+
+	_, _ = bot.SendMessage(&telego.SendMessageParams{
+		ChatID:          telego.ChatID{ID: user.ID},
+		Text:            formatSettings(user),
+		ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+		ReplyMarkup:     settingsKeyboard(user),
+		ParseMode:       "HTML",
+	})
+}
+
+func formatSettings(user *database.User) string {
+	return fmt.Sprintf("<b>Settings</b>\n\n"+
+		"<b>Anonymous mode:</b> %s\nStaff will not see your name on your messages.\n\n"+
+		"<b>Broadcasts:</b> %s\nReceive announcements sent to all users.\n\n"+
+		"<b>Ticket updates:</b> %s\nBe notified when your tickets are closed or reopened.\n\n"+
+		"<b>Language:</b> %s\nThe language you would like staff to answer you in.",
+		onOff(user.Onymity), onOff(!user.DisabledBroadcasts), onOff(!user.DisabledUpdates), languageName(user.Language))
+}
+
+func settingsKeyboard(user *database.User) *telego.InlineKeyboardMarkup {
+	return tu.InlineKeyboard(
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(fmt.Sprintf("Anonymous mode: %s", onOff(user.Onymity))).WithCallbackData("settings=anon"),
+		),
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(fmt.Sprintf("Broadcasts: %s", onOff(!user.DisabledBroadcasts))).WithCallbackData("settings=broadcasts"),
+		),
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(fmt.Sprintf("Ticket updates: %s", onOff(!user.DisabledUpdates))).WithCallbackData("settings=updates"),
+		),
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(fmt.Sprintf("Language: %s", languageName(user.Language))).WithCallbackData("settings=language"),
+		),
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("Done").WithCallbackData("settings=done"),
+		),
+	)
+}
+
+func languageKeyboard() *telego.InlineKeyboardMarkup {
+	var rows [][]telego.InlineKeyboardButton
+	for i := 0; i < len(languages); i += 2 {
+		var row []telego.InlineKeyboardButton
+		for _, language := range languages[i:min(i+2, len(languages))] {
+			row = append(row, tu.InlineKeyboardButton(language.Name).WithCallbackData(fmt.Sprintf("settings_language=%s", language.Tag)))
+		}
+		rows = append(rows, tu.InlineKeyboardRow(row...))
+	}
+	rows = append(rows, tu.InlineKeyboardRow(tu.InlineKeyboardButton("⬅️ Back").WithCallbackData("settings=back")))
+
+	return tu.InlineKeyboard(rows...)
+}
+
+func settingsCallback(bot *TBSTBBot, query *telego.CallbackQuery, db *database.Connection) {
+	var query_msg *telego.Message
+
+	switch query.Message.(type) {
+	case *telego.InaccessibleMessage:
+		bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+			CallbackQueryID: query.ID,
+			Text:            "Could not access the query message.",
+			ShowAlert:       true,
+		})
+		return
+	case *telego.Message:
+		query_msg = query.Message.(*telego.Message)
+	}
+
+	user, err := db.GetUser(query.From.ID)
+	if err != nil {
+		bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+			CallbackQueryID: query.ID,
+			Text:            "Please use /start before changing your settings.",
+			ShowAlert:       true,
+		})
+		return
+	}
+
+	setting, value, _ := strings.Cut(query.Data, "=")
+
+	text := formatSettings(user)
+	markup := settingsKeyboard(user)
+
+	if setting == "settings_language" {
+		if !isLanguage(value) {
+			bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+				CallbackQueryID: query.ID,
+				Text:            "This language is not available.",
+				ShowAlert:       true,
+			})
+			return
+		}
+
+		user.Language = value
+		db.UpdateUser(user)
+
+		text = formatSettings(user)
+		markup = settingsKeyboard(user)
+	} else {
+		switch value {
+		case "anon":
+			user.Onymity = !user.Onymity
+		case "broadcasts":
+			user.DisabledBroadcasts = !user.DisabledBroadcasts
+		case "updates":
+			user.DisabledUpdates = !user.DisabledUpdates
+		case "language":
+			text = "<b>Language</b>\n\nChoose the language you would like staff to answer you in."
+			markup = languageKeyboard()
+		case "done":
+			markup = nil
+		}
+
+		switch value {
+		case "anon", "broadcasts", "updates":
+			db.UpdateUser(user)
+
+			text = formatSettings(user)
+			markup = settingsKeyboard(user)
+		}
+	}
+
+	bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+		CallbackQueryID: query.ID,
+	})
+
+	bot.EditMessageText(&telego.EditMessageTextParams{
+		ChatID:      telego.ChatID{ID: user.ID},
+		MessageID:   query_msg.MessageID,
+		Text:        text,
+		ReplyMarkup: markup,
+		ParseMode:   "HTML",
+	})
+}
+
+// Remove the ticket creator from the receivers of a status update if they turned ticket updates off
+func withoutOptedOut(receivers []int64, creator int64, db *database.Connection) []int64 {
+	user, err := db.GetUser(creator)
+	if err != nil || !user.DisabledUpdates {
+		return receivers
+	}
+
+	return slices.DeleteFunc(receivers, func(id int64) bool {
+		return id == creator
+	})
+}
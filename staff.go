@@ -0,0 +1,431 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	database "github.com/Charibdys/tbstb/database"
+
+	"github.com/mymmrac/telego"
+)
+
+const maxPseudonymLength = 32
+
+// Names used in message headers that a pseudonym could be mistaken for
+var reservedPseudonyms = []string{"admin", "anon", "anonymous", "owner", "staff"}
+
+// Get the name to show other staff members for a role, without revealing the real name of anonymous staff
+func staffName(role *database.Role) string {
+	switch role.Onymity {
+	case "pseudonym":
+		if role.Pseudonym != "" {
+			return role.Pseudonym
+		}
+		// Without a pseudonym, the role is shown as anonymous to users as well
+		fallthrough
+	case "anon":
+		id := fmt.Sprintf("%d", role.ID)
+		return fmt.Sprintf("Anonymous #%s", id[max(0, len(id)-4):])
+	}
+
+	if role.Name == "" {
+		return fmt.Sprintf("Staff #%d", role.ID)
+	}
+	return role.Name
+}
+
+// Check that the pseudonym can be used, returning the reason if not
+func validatePseudonym(pseudonym string) string {
+	if pseudonym == "" {
+		return "The pseudonym cannot be empty."
+	}
+	if utf8.RuneCountInString(pseudonym) > maxPseudonymLength {
+		return fmt.Sprintf("The pseudonym cannot be longer than %d characters.", maxPseudonymLength)
+	}
+
+	for _, char := range pseudonym {
+		if !(unicode.IsLetter(char) || unicode.IsDigit(char) || char == ' ' || char == '-' || char == '_' || char == '.') {
+			return "The pseudonym can only contain letters, digits, spaces, and the characters <code>-_.</code>"
+		}
+	}
+
+	for _, reserved := range reservedPseudonyms {
+		if strings.EqualFold(pseudonym, reserved) {
+			return "This pseudonym is reserved."
+		}
+	}
+
+	return ""
+}
+
+func setnameCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection) {
+	if update.Message.Chat.Type == "group" || update.Message.Chat.Type == "supergroup" {
+		return
+	}
+
+	role, err := db.GetRole(update.Message.From.ID)
+	if err != nil {
+		return
+	}
+
+	_, arg, _ := strings.Cut(update.Message.Text, " ")
+	pseudonym := strings.Join(strings.Fields(arg), " ")
+
+	var text string
+	if pseudonym == "" {
+		if role.Pseudonym == "" {
+			text = "You have not set a pseudonym.\n\nUse <code>/setname NAME</code> to set one."
+		} else {
+			text = fmt.Sprintf("Your pseudonym is <b>%s</b>.\n\nUse <code>/setname NAME</code> to change it.", html.EscapeString(role.Pseudonym))
+		}
+	} else if reason := validatePseudonym(pseudonym); reason != "" {
+		text = reason
+	} else if other, _ := db.GetRoleByPseudonym(pseudonym); other != nil && other.ID != role.ID {
+		text = "This pseudonym is already used by another staff member."
+	} else if err := db.SetPseudonym(role.ID, pseudonym); err != nil {
+		// Another staff member claimed the pseudonym since it was checked
+		text = "This pseudonym is already used by another staff member."
+	} else {
+		text = fmt.Sprintf("Your pseudonym is now <b>%s</b>.", html.EscapeString(pseudonym))
+		if role.Onymity != "pseudonym" {
+			text += "\n\nUse <code>/onymity pseudonym</code> to show it to users instead of your current identity."
+		}
+	}
+
+	_, _ = bot.SendMessage(&telego.SendMessageParams{
+		ChatID:          telego.ChatID{ID: role.ID},
+		Text:            text,
+		ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+		ParseMode:       "HTML",
+	})
+}
+
+func onymityCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection) {
+	if update.Message.Chat.Type == "group" || update.Message.Chat.Type == "supergroup" {
+		return
+	}
+
+	role, err := db.GetRole(update.Message.From.ID)
+	if err != nil {
+		return
+	}
+
+	_, arg, _ := strings.Cut(update.Message.Text, " ")
+	onymity := strings.ToLower(strings.TrimSpace(arg))
+
+	var text string
+	switch onymity {
+	case "":
+		text = fmt.Sprintf("Your messages are currently sent as %s.\n\n"+
+			"Use <code>/onymity anon</code>, <code>/onymity pseudonym</code>, or <code>/onymity realname</code> to change this.",
+			describeOnymity(role))
+	case "anon", "pseudonym", "realname":
+		if onymity == "pseudonym" && role.Pseudonym == "" {
+			text = "Please set a pseudonym with <code>/setname NAME</code> first."
+			break
+		}
+
+		// Keep the real name current, since it is shown to users again
+		if onymity == "realname" {
+			name := update.Message.From.FirstName
+			if update.Message.From.LastName != "" {
+				name = name + " " + update.Message.From.LastName
+			}
+			role.Name = name
+		}
+
+		role.Onymity = onymity
+		db.UpdateRole(role)
+
+		text = fmt.Sprintf("Your messages will now be sent as %s.", describeOnymity(role))
+	default:
+		text = "The onymity must be one of <code>anon</code>, <code>pseudonym</code>, or <code>realname</code>."
+	}
+
+	_, _ = bot.SendMessage(&telego.SendMessageParams{
+		ChatID:          telego.ChatID{ID: role.ID},
+		Text:            text,
+		ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+		ParseMode:       "HTML",
+	})
+}
+
+func describeOnymity(role *database.Role) string {
+	switch role.Onymity {
+	case "anon":
+		return "<b>Admin</b>"
+	case "pseudonym":
+		return fmt.Sprintf("your pseudonym <b>%s</b>", html.EscapeString(role.Pseudonym))
+	default:
+		return "your real name"
+	}
+}
+
+// Check whether the user has a role that grants the permission.
+// The role is returned even if the permission is not granted, and is nil if the user is not staff.
+func authorize(db *database.Connection, id int64, permission string) (*database.Role, bool) {
+	role, err := db.GetRole(id)
+	if err != nil {
+		return nil, false
+	}
+
+	// Read the config for every check, since custom roles are edited in the database directly
+	config, err := db.GetConfig()
+	if err != nil {
+		return role, false
+	}
+
+	return role, config.HasPermission(role.RoleType, permission)
+}
+
+// List the role types that can be given with /promote
+func formatRoleTypes(config *database.Config) string {
+	var names []string
+	for _, role := range config.GetRoleDefinitions() {
+		if role.Name != "owner" {
+			names = append(names, fmt.Sprintf("<code>%s</code>", html.EscapeString(role.Name)))
+		}
+	}
+
+	return strings.Join(names, ", ")
+}
+
+func formatRoleType(roleType string) string {
+	switch roleType {
+	case "owner":
+		return "Owner"
+	case "admin":
+		return "Admin"
+	case "support":
+		return "Support agent"
+	}
+
+	return roleType
+}
+
+// Find the user a role command is about, either from the replied to message or from the first argument.
+// Returns the user, the remaining arguments, and the reason the user could not be found.
+func resolveTarget(bot *TBSTBBot, message *telego.Message, args []string, db *database.Connection) (*database.User, []string, string) {
+	var id int64
+
+	if reply := message.ReplyToMessage; reply != nil {
+		if reply.From != nil && reply.From.ID != bot.User.ID {
+			id = reply.From.ID
+		} else {
+			_, _, relayed := db.GetTicketAndMessage(reply.MessageID, message.Chat.ID)
+			if relayed == nil {
+				return nil, args, "This message is not part of a ticket."
+			}
+			id = relayed.Sender
+		}
+	} else if len(args) > 0 {
+		target := args[0]
+		args = args[1:]
+
+		if strings.HasPrefix(target, "@") {
+			user, err := db.GetUserByUsername(target)
+			if err != nil {
+				return nil, args, "There is no user with this username. They need to /start the bot first."
+			}
+			return user, args, ""
+		}
+
+		parsed, err := strconv.ParseInt(target, 10, 64)
+		if err != nil {
+			return nil, args, "Please give a user ID or @username, or reply to one of their messages."
+		}
+		id = parsed
+	} else {
+		return nil, args, "Please give a user ID or @username, or reply to one of their messages."
+	}
+
+	user, err := db.GetUser(id)
+	if err != nil {
+		return nil, args, "This user has not started the bot yet."
+	}
+
+	return user, args, ""
+}
+
+func promoteCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection) {
+	role, allowed := authorize(db, update.Message.From.ID, database.PermissionManageRoles)
+	if !allowed {
+		return
+	}
+	// Read the config again, since custom roles are edited in the database directly
+	config, err := db.GetConfig()
+	if err != nil {
+		return
+	}
+
+	chatID := update.Message.Chat.ID
+	target, args, reason := resolveTarget(bot, update.Message, strings.Fields(update.Message.Text)[1:], db)
+
+	roleType := "support"
+	if len(args) > 0 {
+		roleType = strings.ToLower(args[0])
+	}
+
+	var text string
+	var current *database.Role
+	if target != nil {
+		current, _ = db.GetRole(target.ID)
+	}
+	switch {
+	case target == nil:
+		text = reason
+	case config.GetRank(roleType) == 0:
+		text = fmt.Sprintf("The role must be one of %s.", formatRoleTypes(config))
+	case roleType == "owner":
+		text = "Owners cannot be appointed with /promote."
+	case target.ID == role.ID:
+		text = "You cannot change your own role."
+	case config.GetRank(roleType) >= config.GetRank(role.RoleType):
+		text = "You can only give roles below your own."
+	case current != nil && config.GetRank(current.RoleType) >= config.GetRank(role.RoleType):
+		text = "You cannot change the role of staff at or above your own rank."
+	case current != nil && current.RoleType == roleType:
+		text = fmt.Sprintf("This user is already a %s.", strings.ToLower(formatRoleType(roleType)))
+	case current != nil && config.GetRank(roleType) < config.GetRank(current.RoleType):
+		text = "Use /demote to lower the role of a staff member."
+	default:
+		if current == nil {
+			db.CreateRole(target.ID, target.Fullname, roleType, config)
+		} else {
+			current.RoleType = roleType
+			db.UpdateRole(current)
+		}
+
+		text = fmt.Sprintf("%s is now a %s.", describeUser(target), strings.ToLower(formatRoleType(roleType)))
+
+		_, err := bot.SendMessage(&telego.SendMessageParams{
+			ChatID: telego.ChatID{ID: target.ID},
+			Text: fmt.Sprintf("You have been made a <b>%s</b>. You will now receive ticket messages and can reply to them.\n\n"+
+				"Use /setname and /onymity to choose how you are shown to users.", strings.ToLower(formatRoleType(roleType))),
+			ParseMode: "HTML",
+		})
+		if err != nil {
+			text += "\nThey could not be notified."
+		}
+	}
+
+	_, _ = bot.SendMessage(&telego.SendMessageParams{
+		ChatID:          telego.ChatID{ID: chatID},
+		Text:            text,
+		ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+		ParseMode:       "HTML",
+	})
+}
+
+func demoteCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection) {
+	role, allowed := authorize(db, update.Message.From.ID, database.PermissionManageRoles)
+	if !allowed {
+		return
+	}
+	config, err := db.GetConfig()
+	if err != nil {
+		return
+	}
+
+	chatID := update.Message.Chat.ID
+	target, args, reason := resolveTarget(bot, update.Message, strings.Fields(update.Message.Text)[1:], db)
+
+	// Without a role, the staff member loses their role entirely
+	roleType := ""
+	if len(args) > 0 {
+		roleType = strings.ToLower(args[0])
+	}
+
+	var text string
+	var current *database.Role
+	if target != nil {
+		current, _ = db.GetRole(target.ID)
+	}
+	switch {
+	case target == nil:
+		text = reason
+	case current == nil:
+		text = "This user is not a staff member."
+	case target.ID == role.ID:
+		text = "You cannot change your own role."
+	case config.GetRank(current.RoleType) >= config.GetRank(role.RoleType):
+		text = "You cannot change the role of staff at or above your own rank."
+	case roleType != "" && config.GetRank(roleType) == 0:
+		text = fmt.Sprintf("The role must be one of %s.", formatRoleTypes(config))
+	case roleType != "" && config.GetRank(roleType) >= config.GetRank(current.RoleType):
+		text = "Use /promote to raise the role of a staff member."
+	default:
+		var notice string
+		if roleType == "" {
+			db.DeleteRole(current.ID)
+
+			text = fmt.Sprintf("%s is no longer a staff member.", describeUser(target))
+			notice = "You are no longer a staff member, and will not receive ticket messages anymore."
+		} else {
+			current.RoleType = roleType
+			db.UpdateRole(current)
+
+			text = fmt.Sprintf("%s is now a %s.", describeUser(target), strings.ToLower(formatRoleType(roleType)))
+			notice = fmt.Sprintf("Your role has been changed to <b>%s</b>.", strings.ToLower(formatRoleType(roleType)))
+		}
+
+		_, _ = bot.SendMessage(&telego.SendMessageParams{
+			ChatID:    telego.ChatID{ID: target.ID},
+			Text:      notice,
+			ParseMode: "HTML",
+		})
+	}
+
+	_, _ = bot.SendMessage(&telego.SendMessageParams{
+		ChatID:          telego.ChatID{ID: chatID},
+		Text:            text,
+		ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+		ParseMode:       "HTML",
+	})
+}
+
+func staffCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection) {
+	if _, allowed := authorize(db, update.Message.From.ID, database.PermissionViewStaff); !allowed {
+		return
+	}
+	config, err := db.GetConfig()
+	if err != nil {
+		return
+	}
+
+	roles := db.GetAllRoles()
+	slices.SortStableFunc(roles, func(a database.Role, b database.Role) int {
+		return config.GetRank(b.RoleType) - config.GetRank(a.RoleType)
+	})
+
+	text := "<b>Staff</b>\n"
+	var last string
+	for _, role := range roles {
+		if role.RoleType != last {
+			text += fmt.Sprintf("\n<b>%ss</b>\n", formatRoleType(role.RoleType))
+			last = role.RoleType
+		}
+
+		// The ID would reveal who is behind an anonymous or pseudonymous role
+		text += fmt.Sprintf("• %s", html.EscapeString(staffName(&role)))
+		if role.Onymity == "realname" {
+			text += fmt.Sprintf(" (<code>%d</code>)", role.ID)
+		}
+		if role.Unreachable {
+			text += " <i>unreachable</i>"
+		}
+		text += "\n"
+	}
+
+	_, _ = bot.SendMessage(&telego.SendMessageParams{
+		ChatID:          telego.ChatID{ID: update.Message.Chat.ID},
+		Text:            text,
+		ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+		ParseMode:       "HTML",
+	})
+}
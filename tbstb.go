@@ -3,7 +3,9 @@ package main
 import (
 	"context"
 	"fmt"
+	"html"
 	"os"
+	"path/filepath"
 	"slices"
 	"strconv"
 	"strings"
@@ -17,18 +19,31 @@ import (
 )
 
 type RelayParams struct {
-	Text      string
-	Media     *string
-	Entities  []telego.MessageEntity
-	Users     []int64
-	Reply     map[int64]int
-	ParseMode string
-	Message   *telego.Message
+	Text         string
+	Media        *string
+	Entities     []telego.MessageEntity
+	Users        []int64
+	Reply        map[int64]int
+	ParseMode    string
+	Message      *telego.Message
+	Album        []telego.Message
+	Attachment   *database.Attachment
+	Continuation []string
+	TicketID     string
+	BroadcastID  string
 }
 
 type TBSTBBot struct {
 	*telego.Bot
-	User *telego.User
+	User    *telego.User
+	Albums  *AlbumCollector
+	Outbox  *Outbox
+	Limiter *RateLimiter
+	Topics  *Topics
+
+	priority Priority
+	// The topics to send to in forum groups, by group ID
+	topics map[int64]int
 }
 
 func AddedToGroup(bot *TBSTBBot) th.Predicate {
@@ -48,6 +63,8 @@ func AddedToGroup(bot *TBSTBBot) th.Predicate {
 
 func main() {
 	botToken := os.Getenv("TOKEN")
+	// Users who start the bot with this secret as the payload become owners
+	setupSecret := os.Getenv("SETUP_SECRET")
 
 	telegoBot, err := telego.NewBot(botToken, telego.WithDiscardLogger())
 	if err != nil {
@@ -61,8 +78,11 @@ func main() {
 	}
 
 	bot := &TBSTBBot{
-		telegoBot,
-		botUser,
+		Bot:     telegoBot,
+		User:    botUser,
+		Albums:  NewAlbumCollector(time.Second, time.Hour),
+		Limiter: NewRateLimiter(),
+		Topics:  NewTopics(),
 	}
 
 	updates, _ := bot.UpdatesViaLongPolling(nil)
@@ -82,14 +102,43 @@ func main() {
 		config = db.HandleConfigError()
 	}
 
+	config.Groups = db.DedupeGroups()
+
+	// Deployments that had an owner before ownership was recorded as claimed cannot be claimed again
+	if db.HasOwner() {
+		db.ClaimOwnership()
+	}
+
+	if setupSecret == "" {
+		fmt.Println("SETUP_SECRET is not set; the first user to start the bot will become its owner")
+	}
+
+	bot.Outbox = NewOutbox(db)
+
 	bh.Handle(func(telegoBot *telego.Bot, update telego.Update) {
-		startCommand(bot, &update, db, config)
+		startCommand(bot, &update, db, config, setupSecret)
 	}, th.CommandEqual("start"))
 
 	bh.Handle(func(telegoBot *telego.Bot, update telego.Update) {
 		broadcastCommand(bot, &update, db)
 	}, th.Union(th.CommandEqual("broadcast"), th.CaptionCommandEqual("broadcast")))
 
+	bh.Handle(func(telegoBot *telego.Bot, update telego.Update) {
+		scheduledCommand(bot, &update, db)
+	}, th.CommandEqual("scheduled"))
+
+	bh.Handle(func(telegoBot *telego.Bot, update telego.Update) {
+		broadcastStatusCommand(bot, &update, db)
+	}, th.CommandEqual("broadcast_status"))
+
+	bh.Handle(func(telegoBot *telego.Bot, update telego.Update) {
+		broadcastDeleteCommand(bot, &update, db)
+	}, th.CommandEqual("broadcast_delete"))
+
+	bh.Handle(func(telegoBot *telego.Bot, update telego.Update) {
+		broadcastEditCommand(bot, &update, db)
+	}, th.CommandEqual("broadcast_edit"))
+
 	bh.Handle(func(telegoBot *telego.Bot, update telego.Update) {
 		versionCommand(bot, &update, db)
 	}, th.CommandEqual("version"))
@@ -111,9 +160,74 @@ func main() {
 	}, th.CommandEqual("assign"))
 
 	bh.Handle(func(telegoBot *telego.Bot, update telego.Update) {
-		registerGroup(bot, &update, db, config)
+		titleCommand(bot, &update, db)
+	}, th.CommandEqual("title"))
+
+	bh.Handle(func(telegoBot *telego.Bot, update telego.Update) {
+		deleteCommand(bot, &update, db)
+	}, th.CommandEqual("delete"))
+
+	bh.Handle(func(telegoBot *telego.Bot, update telego.Update) {
+		categoryCommand(bot, &update, db)
+	}, th.CommandEqual("category"))
+
+	bh.Handle(func(telegoBot *telego.Bot, update telego.Update) {
+		setnameCommand(bot, &update, db)
+	}, th.CommandEqual("setname"))
+
+	bh.Handle(func(telegoBot *telego.Bot, update telego.Update) {
+		onymityCommand(bot, &update, db)
+	}, th.CommandEqual("onymity"))
+
+	bh.Handle(func(telegoBot *telego.Bot, update telego.Update) {
+		promoteCommand(bot, &update, db)
+	}, th.CommandEqual("promote"))
+
+	bh.Handle(func(telegoBot *telego.Bot, update telego.Update) {
+		demoteCommand(bot, &update, db)
+	}, th.CommandEqual("demote"))
+
+	bh.Handle(func(telegoBot *telego.Bot, update telego.Update) {
+		staffCommand(bot, &update, db)
+	}, th.CommandEqual("staff"))
+
+	bh.Handle(func(telegoBot *telego.Bot, update telego.Update) {
+		banCommand(bot, &update, db)
+	}, th.CommandEqual("ban"))
+
+	bh.Handle(func(telegoBot *telego.Bot, update telego.Update) {
+		unbanCommand(bot, &update, db)
+	}, th.CommandEqual("unban"))
+
+	bh.Handle(func(telegoBot *telego.Bot, update telego.Update) {
+		reopenRightsCommand(bot, &update, db)
+	}, th.CommandEqual("reopen_rights"))
+
+	bh.Handle(func(telegoBot *telego.Bot, update telego.Update) {
+		transferOwnerCommand(bot, &update, db)
+	}, th.CommandEqual("transfer_owner"))
+
+	bh.Handle(func(telegoBot *telego.Bot, update telego.Update) {
+		groupsCommand(bot, &update, db)
+	}, th.CommandEqual("groups"))
+
+	bh.Handle(func(telegoBot *telego.Bot, update telego.Update) {
+		settingsCommand(bot, &update, db)
+	}, th.CommandEqual("settings"))
+
+	bh.Handle(func(telegoBot *telego.Bot, update telego.Update) {
+		registerGroup(bot, &update, db)
 	}, AddedToGroup(bot))
 
+	bh.Handle(func(telegoBot *telego.Bot, update telego.Update) {
+		migrateGroup(update.Message, db)
+	}, GroupMigrated())
+
+	bh.HandleMyChatMemberUpdated(func(telegoBot *telego.Bot, update telego.ChatMemberUpdated) {
+		privateMemberUpdated(bot, &update, db)
+		groupMemberUpdated(bot, &update, db)
+	})
+
 	bh.HandleCallbackQuery(func(telegoBot *telego.Bot, query telego.CallbackQuery) {
 		assignToTicket(bot, &query, db)
 	}, th.CallbackDataPrefix("assign_user="))
@@ -131,15 +245,30 @@ func main() {
 	}, th.CallbackDataEqual("cancel_assign"))
 
 	bh.HandleMessage(func(telegoBot *telego.Bot, message telego.Message) {
+		if message.MediaGroupID != "" {
+			album := bot.Albums.Collect(&message)
+			if album == nil {
+				return
+			}
+			message = album[0]
+		}
+
 		if message.Chat.Type == "group" || message.Chat.Type == "supergroup" {
-			groupMessageHandler(bot, &message, db)
+			groupMessageHandler(bot, &message, db, config)
 		} else {
-			privateMessageHandler(bot, &message, db)
+			privateMessageHandler(bot, &message, db, config)
 		}
 	}, th.AnyMessage())
 
+	bh.HandleEditedMessage(func(telegoBot *telego.Bot, message telego.Message) {
+		if broadcastEdited(bot, &message, db) {
+			return
+		}
+		editedMessageHandler(bot, &message, db)
+	}, th.AnyEditedMessageWithFrom())
+
 	bh.HandleCallbackQuery(func(telegoBot *telego.Bot, query telego.CallbackQuery) {
-		newTicket(bot, &query, db)
+		newTicket(bot, &query, db, config)
 	}, th.CallbackDataEqual("new_ticket"))
 
 	bh.HandleCallbackQuery(func(telegoBot *telego.Bot, query telego.CallbackQuery) {
@@ -150,6 +279,34 @@ func main() {
 		cancelAddToTicket(bot, &query)
 	}, th.CallbackDataEqual("cancel_addto"))
 
+	bh.HandleCallbackQuery(func(telegoBot *telego.Bot, query telego.CallbackQuery) {
+		sendBroadcast(bot, &query, db)
+	}, th.CallbackDataPrefix("broadcast_send="))
+
+	bh.HandleCallbackQuery(func(telegoBot *telego.Bot, query telego.CallbackQuery) {
+		cancelBroadcast(bot, &query, db)
+	}, th.CallbackDataPrefix("broadcast_cancel="))
+
+	bh.HandleCallbackQuery(func(telegoBot *telego.Bot, query telego.CallbackQuery) {
+		cancelJob(bot, &query, db)
+	}, th.CallbackDataPrefix("cancel_job="))
+
+	bh.HandleCallbackQuery(func(telegoBot *telego.Bot, query telego.CallbackQuery) {
+		transferOwner(bot, &query, db)
+	}, th.CallbackDataPrefix("transfer_owner="))
+
+	bh.HandleCallbackQuery(func(telegoBot *telego.Bot, query telego.CallbackQuery) {
+		cancelTransferOwner(bot, &query)
+	}, th.CallbackDataEqual("cancel_transfer_owner"))
+
+	bh.HandleCallbackQuery(func(telegoBot *telego.Bot, query telego.CallbackQuery) {
+		unregisterGroup(bot, &query, db)
+	}, th.CallbackDataPrefix("unregister_group="))
+
+	bh.HandleCallbackQuery(func(telegoBot *telego.Bot, query telego.CallbackQuery) {
+		settingsCallback(bot, &query, db)
+	}, th.Union(th.CallbackDataPrefix("settings="), th.CallbackDataPrefix("settings_language=")))
+
 	bh.HandleCallbackQuery(func(telegoBot *telego.Bot, query telego.CallbackQuery) {
 		nextPage(bot, &query, db)
 	}, th.CallbackDataPrefix("next_page="))
@@ -158,6 +315,9 @@ func main() {
 		prevPage(bot, &query, db)
 	}, th.CallbackDataPrefix("prev_page="))
 
+	go bot.Outbox.Run(bot)
+	go NewScheduler(db).Run(bot)
+
 	bh.Start()
 
 	defer func() {
@@ -167,12 +327,17 @@ func main() {
 	}()
 }
 
-func startCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection, config *database.Config) {
+func startCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection, config *database.Config, setupSecret string) {
 	if update.Message.Chat.Type == "group" || update.Message.Chat.Type == "supergroup" {
 		return
 	}
 
-	if db.GetUserCount() != 0 {
+	if claimOwner(bot, update, db, config, setupSecret) {
+		return
+	}
+
+	// Without a setup secret, the first user to start the bot becomes the owner
+	if setupSecret != "" || db.GetUserCount() != 0 || !db.ClaimOwnership() {
 		user, _ := db.GetUser(update.Message.From.ID)
 		if user != nil {
 			_, _ = bot.SendMessage(&telego.SendMessageParams{
@@ -206,13 +371,13 @@ func startCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection,
 
 		_, _ = bot.SendMessage(&telego.SendMessageParams{
 			ChatID:    telego.ChatID{ID: userID},
-			Text:      fmt.Sprintf("Welcome, %s! You have been authorized as owner", name),
+			Text:      fmt.Sprintf("Welcome, %s! You have been authorized as owner", html.EscapeString(name)),
 			ParseMode: "HTML",
 		})
 	}
 }
 
-func registerGroup(bot *TBSTBBot, update *telego.Update, db *database.Connection, config *database.Config) {
+func registerGroup(bot *TBSTBBot, update *telego.Update, db *database.Connection) {
 	admins, err := bot.GetChatAdministrators(&telego.GetChatAdministratorsParams{
 		ChatID: telego.ChatID{ID: update.Message.Chat.ID},
 	})
@@ -240,8 +405,71 @@ func registerGroup(bot *TBSTBBot, update *telego.Update, db *database.Connection
 		return
 	}
 
-	config.Groups = append(config.Groups, update.Message.Chat.ID)
-	db.UpdateConfig(config)
+	db.AddGroup(update.Message.Chat.ID)
+}
+
+// Track whether private chats with the bot are blocked or restarted
+func privateMemberUpdated(bot *TBSTBBot, update *telego.ChatMemberUpdated, db *database.Connection) {
+	if update.Chat.Type != "private" {
+		return
+	}
+
+	switch update.NewChatMember.MemberStatus() {
+	case "kicked":
+		markUnreachable(bot, db, update.Chat.ID)
+	case "member":
+		db.SetUnreachable(update.Chat.ID, false)
+	}
+}
+
+// Stop relaying to a user who can no longer receive messages, and tell staff about it
+func markUnreachable(bot *TBSTBBot, db *database.Connection, id int64) {
+	if !db.SetUnreachable(id, true) {
+		return
+	}
+
+	var text string
+	role, _ := db.GetRole(id)
+	if role != nil {
+		text = fmt.Sprintf("Staff member <b>%s</b> has blocked the bot and will not receive messages until they start it again.",
+			html.EscapeString(staffName(role)))
+	} else {
+		tickets := db.GetOpenTicketSummaries(id)
+		if len(tickets) == 0 {
+			return
+		}
+
+		text = "The creator of these tickets has blocked the bot and can no longer be reached:\n\n"
+		for i, ticket := range tickets {
+			text += formatTicketEntry(i+1, &ticket)
+		}
+	}
+
+	receivers := db.GetRoleReceivers(&id)
+	receivers = append(receivers, db.GetGroupReceivers()...)
+
+	for _, receiver := range receivers {
+		_, _ = bot.SendMessage(&telego.SendMessageParams{
+			ChatID:    telego.ChatID{ID: receiver},
+			Text:      text,
+			ParseMode: "HTML",
+		})
+	}
+}
+
+// Tell staff replying to a ticket that its creator will not receive the reply
+func warnUnreachable(bot *TBSTBBot, message *telego.Message, db *database.Connection, ticket *database.Ticket, id_short string) {
+	creator, err := db.GetUser(ticket.Creator)
+	if err != nil || !creator.Unreachable {
+		return
+	}
+
+	_, _ = bot.SendMessage(&telego.SendMessageParams{
+		ChatID:          telego.ChatID{ID: message.Chat.ID},
+		Text:            fmt.Sprintf("The creator of ticket <code>%s</code> has blocked the bot and will not receive this message.", id_short),
+		ReplyParameters: &telego.ReplyParameters{MessageID: message.MessageID},
+		ParseMode:       "HTML",
+	})
 }
 
 func noUser(bot *TBSTBBot, message *telego.Message) {
@@ -256,17 +484,43 @@ func noUser(bot *TBSTBBot, message *telego.Message) {
 	})
 }
 
-func groupMessageHandler(bot *TBSTBBot, message *telego.Message, db *database.Connection) {
+func groupMessageHandler(bot *TBSTBBot, message *telego.Message, db *database.Connection, config *database.Config) {
 	user, err := db.GetUser(message.From.ID)
 	if err != nil {
 		return
 	}
 
-	if message.ReplyToMessage == nil {
+	// Pins and topic changes are not written by anyone, so there is nothing to relay or refuse
+	if isServiceMessage(message) {
+		return
+	}
+
+	role, _ := db.GetRole(user.ID)
+
+	// In registered forum groups, any message from staff in the topic of a ticket is a reply to it
+	var topicID string
+	var topicTicket *database.Ticket
+	if role != nil && message.IsTopicMessage && message.MessageThreadID != 0 && slices.Contains(db.GetGroupReceivers(), message.Chat.ID) {
+		topicID, _, topicTicket = db.GetTicketFromTopic(message.Chat.ID, message.MessageThreadID)
+	}
+
+	repliedToBot := message.ReplyToMessage != nil && message.ReplyToMessage.From != nil && message.ReplyToMessage.From.ID == bot.User.ID
+	if !repliedToBot && topicTicket == nil {
 		return
 	}
 
-	if message.ReplyToMessage.From.ID != bot.User.ID {
+	if !isRelayable(message) {
+		unsupportedMessage(bot, message)
+		return
+	}
+
+	if reason := checkMediaPolicy(bot, message, config); reason != "" {
+		_, _ = bot.SendMessage(&telego.SendMessageParams{
+			ChatID:          telego.ChatID{ID: message.Chat.ID},
+			Text:            reason,
+			ReplyParameters: &telego.ReplyParameters{MessageID: message.MessageID},
+			ParseMode:       "HTML",
+		})
 		return
 	}
 
@@ -277,7 +531,16 @@ func groupMessageHandler(bot *TBSTBBot, message *telego.Message, db *database.Co
 		text = message.Caption
 	}
 
-	id, ticket, reply_message := db.GetTicketAndMessage(message.ReplyToMessage.MessageID, user.ID)
+	var id string
+	var ticket *database.Ticket
+	var reply_message *database.Message
+	if repliedToBot {
+		id, ticket, reply_message = db.GetTicketAndMessage(message.ReplyToMessage.MessageID, message.Chat.ID)
+	}
+	// Messages that do not reply to a relayed message reply to the first message of the ticket
+	if ticket == nil && topicTicket != nil {
+		id, ticket, reply_message = topicID, topicTicket, &topicTicket.Messages[0]
+	}
 	if ticket == nil {
 		_, _ = bot.SendMessage(&telego.SendMessageParams{
 			ChatID:          telego.ChatID{ID: message.Chat.ID},
@@ -301,16 +564,18 @@ func groupMessageHandler(bot *TBSTBBot, message *telego.Message, db *database.Co
 	reply_to := reply_message.GetMessageReceivers()
 	id_short := id[len(id)-7:]
 	media, uniqueMediaID := getMessageMediaID(message)
+	album := getAlbum(bot, message)
+	attachment := getMessageAttachment(message)
 
-	var fmtText string
+	var header string
 	var receivers []int64
 
-	role, _ := db.GetRole(user.ID)
 	if role != nil {
-		fmtText = formatRoleMessage(text, user, role, id_short)
+		header = formatRoleMessage("", user, role, id_short)
 		receivers = db.GetOriginReceivers(&role.ID, ticket.Creator)
+		warnUnreachable(bot, message, db, ticket, id_short)
 	} else {
-		fmtText = formatMessage(text, user, id_short)
+		header = formatMessage("", user, id_short)
 		if ticket.Assignees != nil {
 			receivers = db.GetAssigneeReceivers(ticket.Assignees)
 		} else {
@@ -318,40 +583,72 @@ func groupMessageHandler(bot *TBSTBBot, message *telego.Message, db *database.Co
 		}
 	}
 
-	confirmedReceivers := sendMessage(&RelayParams{
-		Text:      fmtText,
-		Media:     media,
-		Users:     receivers,
-		Reply:     reply_to,
-		ParseMode: "HTML",
-		Message:   message,
-	}, bot)
-
-	confirmedReceivers = append(confirmedReceivers, database.Receiver{
-		MSID:   message.MessageID,
-		UserID: user.ID,
-	})
+	topics := ensureTopics(bot, db, id, ticket)
+	receivers = withTopics(receivers, topics, message.Chat.ID)
 
+	// Store the message before relaying it, so failures recorded while relaying have a message to be added to
 	db.AppendMessage(id, &database.Message{
 		Sender:        user.ID,
 		OriginMSID:    message.MessageID,
 		DateSent:      time.Now(),
-		Receivers:     confirmedReceivers,
+		Receivers:     originReceivers(message, album, user.ID),
 		Text:          &text,
 		Media:         media,
 		UniqueMediaID: uniqueMediaID,
+		MediaGroup:    getMediaGroup(album),
+		Attachment:    attachment,
 	})
+
+	fmtText, continuation := formatRelayText(message, header, media != nil)
+
+	confirmedReceivers := sendMessage(&RelayParams{
+		Text:         fmtText,
+		Media:        media,
+		Users:        receivers,
+		Reply:        reply_to,
+		ParseMode:    "HTML",
+		Message:      message,
+		Album:        album,
+		Attachment:   attachment,
+		Continuation: continuation,
+		TicketID:     id,
+	}, bot.InTopics(topics))
+
+	db.AppendReceivers(id, user.ID, message.MessageID, confirmedReceivers)
 }
 
-func privateMessageHandler(bot *TBSTBBot, message *telego.Message, db *database.Connection) {
+func privateMessageHandler(bot *TBSTBBot, message *telego.Message, db *database.Connection, config *database.Config) {
 	user, err := db.GetUser(message.From.ID)
 	if err != nil {
 		noUser(bot, message)
 		return
 	}
 
+	if refuseBanned(bot, db, user, message) {
+		return
+	}
+
+	if !isRelayable(message) {
+		unsupportedMessage(bot, message)
+		return
+	}
+
+	if reason := checkMediaPolicy(bot, message, config); reason != "" {
+		_, _ = bot.SendMessage(&telego.SendMessageParams{
+			ChatID:          telego.ChatID{ID: message.Chat.ID},
+			Text:            reason,
+			ReplyParameters: &telego.ReplyParameters{MessageID: message.MessageID},
+			ParseMode:       "HTML",
+		})
+		return
+	}
+
 	if message.ReplyToMessage == nil {
-		noReply(bot, message.MessageID, db.GetTicketIDs(user.ID), user)
+		noReply(bot, message.MessageID, db.GetTicketSummaries(user.ID), user)
+		return
+	}
+
+	if setTitleFromPrompt(bot, message, db, user) {
 		return
 	}
 
@@ -386,16 +683,19 @@ func privateMessageHandler(bot *TBSTBBot, message *telego.Message, db *database.
 	reply_to := reply_message.GetMessageReceivers()
 	id_short := id[len(id)-7:]
 	media, uniqueMediaID := getMessageMediaID(message)
+	album := getAlbum(bot, message)
+	attachment := getMessageAttachment(message)
 
-	var fmtText string
+	var header string
 	var receivers []int64
 
 	role, _ := db.GetRole(user.ID)
 	if role != nil {
-		fmtText = formatRoleMessage(text, user, role, id_short)
+		header = formatRoleMessage("", user, role, id_short)
 		receivers = db.GetOriginReceivers(&role.ID, ticket.Creator)
+		warnUnreachable(bot, message, db, ticket, id_short)
 	} else {
-		fmtText = formatMessage(text, user, id_short)
+		header = formatMessage("", user, id_short)
 		if ticket.Assignees != nil {
 			receivers = db.GetAssigneeReceivers(ticket.Assignees)
 		} else {
@@ -403,48 +703,191 @@ func privateMessageHandler(bot *TBSTBBot, message *telego.Message, db *database.
 		}
 	}
 
-	confirmedReceivers := sendMessage(&RelayParams{
-		Text:      fmtText,
-		Media:     media,
-		Users:     receivers,
-		Reply:     reply_to,
-		ParseMode: "HTML",
-		Message:   message,
-	}, bot)
-
-	confirmedReceivers = append(confirmedReceivers, database.Receiver{
-		MSID:   message.MessageID,
-		UserID: user.ID,
-	})
+	topics := ensureTopics(bot, db, id, ticket)
+	receivers = withTopics(receivers, topics, message.Chat.ID)
 
+	// Store the message before relaying it, so failures recorded while relaying have a message to be added to
 	db.AppendMessage(id, &database.Message{
 		Sender:        user.ID,
 		OriginMSID:    message.MessageID,
 		DateSent:      time.Now(),
-		Receivers:     confirmedReceivers,
+		Receivers:     originReceivers(message, album, user.ID),
 		Text:          &text,
 		Media:         media,
 		UniqueMediaID: uniqueMediaID,
+		MediaGroup:    getMediaGroup(album),
+		Attachment:    attachment,
 	})
+
+	fmtText, continuation := formatRelayText(message, header, media != nil)
+
+	confirmedReceivers := sendMessage(&RelayParams{
+		Text:         fmtText,
+		Media:        media,
+		Users:        receivers,
+		Reply:        reply_to,
+		ParseMode:    "HTML",
+		Message:      message,
+		Album:        album,
+		Attachment:   attachment,
+		Continuation: continuation,
+		TicketID:     id,
+	}, bot.InTopics(topics))
+
+	db.AppendReceivers(id, user.ID, message.MessageID, confirmedReceivers)
+}
+
+func editedMessageHandler(bot *TBSTBBot, message *telego.Message, db *database.Connection) {
+	user, err := db.GetUser(message.From.ID)
+	if err != nil || checkBanned(db, user) {
+		return
+	}
+
+	id, _, original := db.GetTicketAndOrigin(message.MessageID, user.ID)
+	if original == nil || original.Text == nil || original.DeletedBy != nil {
+		return
+	}
+
+	var text string
+	if message.Text != "" {
+		text = message.Text
+	} else if message.Caption != "" {
+		text = message.Caption
+	}
+
+	if text == *original.Text {
+		return
+	}
+
+	id_short := id[len(id)-7:]
+
+	var header string
+	role, _ := db.GetRole(user.ID)
+	if role != nil {
+		header = formatRoleMessage("", user, role, id_short)
+	} else {
+		header = formatMessage("", user, id_short)
+	}
+
+	fmtText, continuation := formatRelayText(message, header, original.Media != nil)
+	parts := append([]string{fmtText}, continuation...)
+
+	var receivers []database.Receiver
+	for _, receiver := range original.Receivers {
+		if receiver.UserID != user.ID {
+			receivers = append(receivers, receiver)
+		}
+	}
+
+	items := max(len(original.MediaGroup), 1)
+	if _, truncated := editCopies(bot, receivers, parts, original.Media != nil, items); truncated {
+		_, _ = bot.SendMessage(&telego.SendMessageParams{
+			ChatID:          telego.ChatID{ID: user.ID},
+			Text:            "Your edit is longer than the message that was sent, so staff will only see the beginning of it. Please send the rest as a new message.",
+			ReplyParameters: &telego.ReplyParameters{MessageID: message.MessageID},
+			ParseMode:       "HTML",
+		})
+	}
+
+	db.EditMessage(id, original, &text)
+}
+
+// Edit every relayed copy of a message to the given parts: the text or caption of the message, then its continuations.
+// items is the number of messages the content was sent as, which is more than one for albums.
+// Continuations that are no longer needed are cleared, as copies can only be edited.
+// Returns the number of users whose copy was edited, and whether any copy had too few messages to fit all the parts.
+func editCopies(bot *TBSTBBot, receivers []database.Receiver, parts []string, caption bool, items int) (int, bool) {
+	// Each receiver's copies are stored in the order they were sent: the message itself, then its continuations
+	copies := make(map[int64][]int)
+	for _, receiver := range receivers {
+		copies[receiver.UserID] = append(copies[receiver.UserID], receiver.MSID)
+	}
+
+	edited := 0
+	truncated := false
+	for userID, msids := range copies {
+		// Only the first item of an album has the header and caption
+		targets := msids[:1]
+		if len(msids) > items {
+			targets = append(targets, msids[items:]...)
+		}
+
+		if len(parts) > len(targets) {
+			truncated = true
+		}
+
+		for i, msid := range targets {
+			part := "<i>This part was removed by an edit.</i>"
+			if i < len(parts) {
+				part = parts[i]
+			}
+
+			var err error
+			if i == 0 && caption {
+				_, err = bot.EditMessageCaption(&telego.EditMessageCaptionParams{
+					ChatID:    telego.ChatID{ID: userID},
+					MessageID: msid,
+					Caption:   part,
+					ParseMode: "HTML",
+				})
+			} else {
+				_, err = bot.EditMessageText(&telego.EditMessageTextParams{
+					ChatID:    telego.ChatID{ID: userID},
+					MessageID: msid,
+					Text:      part,
+					ParseMode: "HTML",
+				})
+			}
+			if err != nil {
+				fmt.Printf("%s\n", err)
+			} else if i == 0 {
+				edited++
+			}
+		}
+	}
+
+	return edited, truncated
 }
 
+// Add the sender header to text that has already been rendered as HTML.
+// Staff are shown the language the user would like to be answered in, if they chose one.
 func formatMessage(text string, user *database.User, ticket string) string {
+	var language string
+	if user.Language != "" {
+		language = fmt.Sprintf(", Language: %s", languageName(user.Language))
+	}
+
 	if user.Onymity {
-		text = fmt.Sprintf("<b>Anonymous</b>, Ticket: <code>%s</code>\n\n", ticket) + text
+		text = fmt.Sprintf("<b>Anonymous</b>, Ticket: <code>%s</code>%s\n\n", ticket, language) + text
 	} else {
-		text = fmt.Sprintf("<b><a href=\"tg://user?id=%d\">%s</a></b>, Ticket: <code>%s</code>\n\n", user.ID, user.Fullname, ticket) + text
+		text = fmt.Sprintf("<b><a href=\"tg://user?id=%d\">%s</a></b>, Ticket: <code>%s</code>%s\n\n", user.ID, html.EscapeString(user.Fullname), ticket, language) + text
 	}
 
 	return text
 }
 
+func formatTitle(title string) string {
+	if title == "" {
+		return "<i>Untitled</i>"
+	}
+
+	return fmt.Sprintf("<b>%s</b>", html.EscapeString(title))
+}
+
+func formatTicketEntry(index int, ticket *database.TicketSummary) string {
+	id := ticket.ID.Hex()
+
+	return fmt.Sprintf("<b>%d.</b> <code>%s</code> %s\n", index, id[len(id)-7:], formatTitle(ticket.Title))
+}
+
+// Add the role header to text that has already been rendered as HTML
 func formatRoleMessage(text string, user *database.User, role *database.Role, ticket string) string {
-	if role.Onymity == "anon" {
+	if role.Onymity == "anon" || (role.Onymity == "pseudonym" && role.Pseudonym == "") {
 		text = fmt.Sprintf("<b>Admin</b>, Ticket: <code>%s</code>\n\n", ticket) + text
 	} else if role.Onymity == "pseudonym" {
-		text = fmt.Sprintf("<b>%s</b>, Ticket: <code>%s</code>\n\n", role.Name, ticket) + text
+		text = fmt.Sprintf("<b>%s</b>, Ticket: <code>%s</code>\n\n", html.EscapeString(role.Pseudonym), ticket) + text
 	} else {
-		text = fmt.Sprintf("<b><a href=\"tg://user?id=%d\">%s</a></b>, Ticket: <code>%s</code>\n\n", user.ID, user.Fullname, ticket) + text
+		text = fmt.Sprintf("<b><a href=\"tg://user?id=%d\">%s</a></b>, Ticket: <code>%s</code>\n\n", user.ID, html.EscapeString(user.Fullname), ticket) + text
 	}
 
 	return text
@@ -454,23 +897,60 @@ func sendMessage(params *RelayParams, bot *TBSTBBot) []database.Receiver {
 	var receivers []database.Receiver
 
 	for _, roleID := range params.Users {
-		msg := relay(roleID, params, bot)
-		if msg == nil {
+		msgs, err := relay(roleID, params, bot)
+		if err != nil {
+			fmt.Printf("%s\n", err)
+			bot.Outbox.HandleFailure(bot, roleID, params, err)
 			continue
 		}
-		receivers = append(receivers, database.Receiver{
-			MSID:   msg.MessageID,
-			UserID: roleID,
-		})
+
+		for _, msg := range msgs {
+			receivers = append(receivers, database.Receiver{
+				MSID:   msg.MessageID,
+				UserID: roleID,
+			})
+		}
 	}
 
 	return receivers
 }
 
-func relay(id int64, params *RelayParams, bot *TBSTBBot) *telego.Message {
-	var msg *telego.Message
+// Relay a message to a single receiver.
+// Once the message itself has been sent, failing to send a continuation is not treated as an error.
+func relay(id int64, params *RelayParams, bot *TBSTBBot) ([]telego.Message, error) {
+	msgs, err := relayContent(id, params, bot)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, part := range params.Continuation {
+		msg, err := bot.SendMessage(&telego.SendMessageParams{
+			ChatID:          telego.ChatID{ID: id},
+			Text:            part,
+			ParseMode:       params.ParseMode,
+			ReplyParameters: &telego.ReplyParameters{MessageID: msgs[0].MessageID},
+		})
+		if err != nil {
+			fmt.Printf("%s\n", err)
+			break
+		}
+		msgs = append(msgs, *msg)
+	}
+
+	return msgs, nil
+}
+
+func relayContent(id int64, params *RelayParams, bot *TBSTBBot) ([]telego.Message, error) {
+	if len(params.Album) > 1 {
+		return relayAlbum(id, params, bot)
+	}
+	if params.Attachment != nil {
+		return relayAttachment(id, params, bot)
+	}
+
+	var msg, header *telego.Message
+	var err error
 	if params.Media == nil {
-		var err error
 		msg, err = bot.SendMessage(&telego.SendMessageParams{
 			ChatID:          telego.ChatID{ID: id},
 			Text:            params.Text,
@@ -478,13 +958,10 @@ func relay(id int64, params *RelayParams, bot *TBSTBBot) *telego.Message {
 			Entities:        params.Entities,
 			ReplyParameters: &telego.ReplyParameters{MessageID: params.Reply[id]},
 		})
-		if err != nil {
-			fmt.Printf("%s\n", err)
-		}
 	} else {
 		switch {
 		case params.Message.Animation != nil:
-			msg, _ = bot.SendAnimation(&telego.SendAnimationParams{
+			msg, err = bot.SendAnimation(&telego.SendAnimationParams{
 				ChatID:  telego.ChatID{ID: id},
 				Caption: params.Text,
 				Animation: telego.InputFile{
@@ -495,7 +972,7 @@ func relay(id int64, params *RelayParams, bot *TBSTBBot) *telego.Message {
 				ReplyParameters: &telego.ReplyParameters{MessageID: params.Reply[id]},
 			})
 		case params.Message.Document != nil:
-			msg, _ = bot.SendDocument(&telego.SendDocumentParams{
+			msg, err = bot.SendDocument(&telego.SendDocumentParams{
 				ChatID:  telego.ChatID{ID: id},
 				Caption: params.Text,
 				Document: telego.InputFile{
@@ -506,14 +983,16 @@ func relay(id int64, params *RelayParams, bot *TBSTBBot) *telego.Message {
 				ReplyParameters: &telego.ReplyParameters{MessageID: params.Reply[id]},
 			})
 		case params.Message.Sticker != nil:
-			msg, _ = bot.SendSticker(&telego.SendStickerParams{
+			header = sendHeader(id, params, bot)
+			msg, err = bot.SendSticker(&telego.SendStickerParams{
 				ChatID: telego.ChatID{ID: id},
 				Sticker: telego.InputFile{
 					FileID: *params.Media,
 				},
+				ReplyParameters: &telego.ReplyParameters{MessageID: headerReply(id, header, params)},
 			})
 		case params.Message.Video != nil:
-			msg, _ = bot.SendVideo(&telego.SendVideoParams{
+			msg, err = bot.SendVideo(&telego.SendVideoParams{
 				ChatID:  telego.ChatID{ID: id},
 				Caption: params.Text,
 				Video: telego.InputFile{
@@ -524,14 +1003,16 @@ func relay(id int64, params *RelayParams, bot *TBSTBBot) *telego.Message {
 				ReplyParameters: &telego.ReplyParameters{MessageID: params.Reply[id]},
 			})
 		case params.Message.VideoNote != nil:
-			msg, _ = bot.SendVideoNote(&telego.SendVideoNoteParams{
+			header = sendHeader(id, params, bot)
+			msg, err = bot.SendVideoNote(&telego.SendVideoNoteParams{
 				ChatID: telego.ChatID{ID: id},
 				VideoNote: telego.InputFile{
 					FileID: *params.Media,
 				},
+				ReplyParameters: &telego.ReplyParameters{MessageID: headerReply(id, header, params)},
 			})
 		case params.Message.Audio != nil:
-			msg, _ = bot.SendAudio(&telego.SendAudioParams{
+			msg, err = bot.SendAudio(&telego.SendAudioParams{
 				ChatID:  telego.ChatID{ID: id},
 				Caption: params.Text,
 				Audio: telego.InputFile{
@@ -542,7 +1023,7 @@ func relay(id int64, params *RelayParams, bot *TBSTBBot) *telego.Message {
 				ReplyParameters: &telego.ReplyParameters{MessageID: params.Reply[id]},
 			})
 		case params.Message.Photo != nil:
-			msg, _ = bot.SendPhoto(&telego.SendPhotoParams{
+			msg, err = bot.SendPhoto(&telego.SendPhotoParams{
 				ChatID:  telego.ChatID{ID: id},
 				Caption: params.Text,
 				Photo: telego.InputFile{
@@ -553,7 +1034,7 @@ func relay(id int64, params *RelayParams, bot *TBSTBBot) *telego.Message {
 				ReplyParameters: &telego.ReplyParameters{MessageID: params.Reply[id]},
 			})
 		case params.Message.Voice != nil:
-			msg, _ = bot.SendVoice(&telego.SendVoiceParams{
+			msg, err = bot.SendVoice(&telego.SendVoiceParams{
 				ChatID:  telego.ChatID{ID: id},
 				Caption: params.Text,
 				Voice: telego.InputFile{
@@ -564,31 +1045,360 @@ func relay(id int64, params *RelayParams, bot *TBSTBBot) *telego.Message {
 				ReplyParameters: &telego.ReplyParameters{MessageID: params.Reply[id]},
 			})
 		default:
-			return nil
+			return nil, nil
 		}
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []telego.Message
+	if header != nil {
+		msgs = append(msgs, *header)
+	}
+	if msg != nil {
+		msgs = append(msgs, *msg)
+	}
 
-	return msg
+	return msgs, nil
 }
 
-func noReply(bot *TBSTBBot, original_message int, ticket_ids []string, user *database.User) {
-	text := "No reply found.\n\n" +
-		"Would you like to create a new ticket with this message " +
-		"or add this message to one of your tickets?\n\n"
+// Send the header of content that cannot have a caption as a separate message
+func sendHeader(id int64, params *RelayParams, bot *TBSTBBot) *telego.Message {
+	if strings.TrimSpace(params.Text) == "" {
+		return nil
+	}
 
-	var ticket_options []telego.InlineKeyboardButton
-	if ticket_ids != nil {
-		limit := 3
-		ticket_count := len(ticket_ids)
-		if ticket_count <= 3 {
+	header, err := bot.SendMessage(&telego.SendMessageParams{
+		ChatID:          telego.ChatID{ID: id},
+		Text:            params.Text,
+		ParseMode:       params.ParseMode,
+		Entities:        params.Entities,
+		ReplyParameters: &telego.ReplyParameters{MessageID: params.Reply[id]},
+	})
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return nil
+	}
+
+	return header
+}
+
+// Content sent after a header replies to the header, otherwise to the message being replied to
+func headerReply(id int64, header *telego.Message, params *RelayParams) int {
+	if header != nil {
+		return header.MessageID
+	}
+
+	return params.Reply[id]
+}
+
+// Relay content that cannot have a caption; the header is sent as a separate message
+func relayAttachment(id int64, params *RelayParams, bot *TBSTBBot) ([]telego.Message, error) {
+	var msgs []telego.Message
+
+	header := sendHeader(id, params, bot)
+	if header != nil {
+		msgs = append(msgs, *header)
+	}
+	reply := headerReply(id, header, params)
+
+	attachment := params.Attachment
+
+	var msg *telego.Message
+	var err error
+	switch attachment.Type {
+	case "location":
+		msg, err = bot.SendLocation(&telego.SendLocationParams{
+			ChatID:          telego.ChatID{ID: id},
+			Latitude:        attachment.Latitude,
+			Longitude:       attachment.Longitude,
+			ReplyParameters: &telego.ReplyParameters{MessageID: reply},
+		})
+	case "venue":
+		msg, err = bot.SendVenue(&telego.SendVenueParams{
+			ChatID:          telego.ChatID{ID: id},
+			Latitude:        attachment.Latitude,
+			Longitude:       attachment.Longitude,
+			Title:           attachment.Title,
+			Address:         attachment.Address,
+			ReplyParameters: &telego.ReplyParameters{MessageID: reply},
+		})
+	case "contact":
+		msg, err = bot.SendContact(&telego.SendContactParams{
+			ChatID:          telego.ChatID{ID: id},
+			PhoneNumber:     attachment.PhoneNumber,
+			FirstName:       attachment.FirstName,
+			LastName:        attachment.LastName,
+			ReplyParameters: &telego.ReplyParameters{MessageID: reply},
+		})
+	case "poll":
+		var options []telego.InputPollOption
+		for _, option := range attachment.Options {
+			options = append(options, telego.InputPollOption{Text: option})
+		}
+		msg, err = bot.SendPoll(&telego.SendPollParams{
+			ChatID:          telego.ChatID{ID: id},
+			Question:        attachment.Question,
+			Options:         options,
+			ReplyParameters: &telego.ReplyParameters{MessageID: reply},
+		})
+	case "dice":
+		// Sending a new dice would roll a different value, so copy the original instead
+		var copied *telego.MessageID
+		copied, err = bot.CopyMessage(&telego.CopyMessageParams{
+			ChatID:          telego.ChatID{ID: id},
+			FromChatID:      telego.ChatID{ID: params.Message.Chat.ID},
+			MessageID:       params.Message.MessageID,
+			ReplyParameters: &telego.ReplyParameters{MessageID: reply},
+		})
+		if copied != nil {
+			msg = &telego.Message{MessageID: copied.MessageID}
+		}
+	case "story":
+		// Stories can only be forwarded
+		msg, err = bot.ForwardMessage(&telego.ForwardMessageParams{
+			ChatID:     telego.ChatID{ID: id},
+			FromChatID: telego.ChatID{ID: params.Message.Chat.ID},
+			MessageID:  params.Message.MessageID,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if msg != nil {
+		msgs = append(msgs, *msg)
+	}
+
+	return msgs, nil
+}
+
+func getMessageAttachment(message *telego.Message) *database.Attachment {
+	switch {
+	case message.Venue != nil:
+		return &database.Attachment{
+			Type:      "venue",
+			Latitude:  message.Venue.Location.Latitude,
+			Longitude: message.Venue.Location.Longitude,
+			Title:     message.Venue.Title,
+			Address:   message.Venue.Address,
+		}
+	case message.Location != nil:
+		return &database.Attachment{
+			Type:      "location",
+			Latitude:  message.Location.Latitude,
+			Longitude: message.Location.Longitude,
+		}
+	case message.Contact != nil:
+		return &database.Attachment{
+			Type:        "contact",
+			PhoneNumber: message.Contact.PhoneNumber,
+			FirstName:   message.Contact.FirstName,
+			LastName:    message.Contact.LastName,
+		}
+	case message.Poll != nil:
+		var options []string
+		for _, option := range message.Poll.Options {
+			options = append(options, option.Text)
+		}
+		return &database.Attachment{
+			Type:     "poll",
+			Question: message.Poll.Question,
+			Options:  options,
+		}
+	case message.Dice != nil:
+		return &database.Attachment{
+			Type:  "dice",
+			Emoji: message.Dice.Emoji,
+			Value: message.Dice.Value,
+		}
+	case message.Story != nil:
+		return &database.Attachment{
+			Type:        "story",
+			StoryChatID: message.Story.Chat.ID,
+			StoryID:     message.Story.ID,
+		}
+	}
+	return nil
+}
+
+// Check if the message has any content that can be relayed
+func isRelayable(message *telego.Message) bool {
+	media, _ := getMessageMediaID(message)
+
+	return message.Text != "" || message.Caption != "" || media != nil || getMessageAttachment(message) != nil
+}
+
+// Check if the message is a service message, such as a pin or a change to the chat or one of its topics
+func isServiceMessage(message *telego.Message) bool {
+	return message.PinnedMessage != nil || message.NewChatMembers != nil || message.LeftChatMember != nil ||
+		message.NewChatTitle != "" || message.NewChatPhoto != nil || message.DeleteChatPhoto ||
+		message.MessageAutoDeleteTimerChanged != nil || message.ForumTopicCreated != nil ||
+		message.ForumTopicEdited != nil || message.ForumTopicClosed != nil || message.ForumTopicReopened != nil ||
+		message.GeneralForumTopicHidden != nil || message.GeneralForumTopicUnhidden != nil ||
+		message.VideoChatScheduled != nil || message.VideoChatStarted != nil || message.VideoChatEnded != nil ||
+		message.VideoChatParticipantsInvited != nil || message.ChatBackgroundSet != nil || message.BoostAdded != nil
+}
+
+// Check the media of a message, or of every item in its album, against the media policy.
+// Returns the reason the media cannot be relayed, or an empty string if it can be.
+func checkMediaPolicy(bot *TBSTBBot, message *telego.Message, config *database.Config) string {
+	items := getAlbum(bot, message)
+	if items == nil {
+		items = []telego.Message{*message}
+	}
+
+	for _, item := range items {
+		mediaType := getMessageMediaType(&item)
+		if mediaType == "" {
+			continue
+		}
+
+		if !config.RelayMedia {
+			return "Sorry, media cannot be sent through this bot. Please send your message as text."
+		}
+
+		policy := config.GetMediaPolicy(mediaType)
+		if policy == nil {
+			continue
+		}
+
+		name := strings.ReplaceAll(mediaType, "_", " ")
+		if !policy.Allowed {
+			return fmt.Sprintf("Sorry, %ss cannot be sent through this bot.", name)
+		}
+
+		size, filename := getMessageMediaInfo(&item)
+		if policy.MaxSize != 0 && size > policy.MaxSize {
+			return fmt.Sprintf("Sorry, %ss larger than %d MB cannot be sent through this bot.", name, policy.MaxSize/(1024*1024))
+		}
+
+		extension := strings.ToLower(filepath.Ext(filename))
+		if extension != "" && slices.Contains(policy.BlockedExtensions, extension) {
+			return fmt.Sprintf("Sorry, files with the <code>%s</code> extension cannot be sent through this bot.", html.EscapeString(extension))
+		}
+	}
+
+	return ""
+}
+
+func unsupportedMessage(bot *TBSTBBot, message *telego.Message) {
+	_, _ = bot.SendMessage(&telego.SendMessageParams{
+		ChatID:          telego.ChatID{ID: message.Chat.ID},
+		Text:            "This type of message is not supported and was not delivered.",
+		ReplyParameters: &telego.ReplyParameters{MessageID: message.MessageID},
+		ParseMode:       "HTML",
+	})
+}
+
+func relayAlbum(id int64, params *RelayParams, bot *TBSTBBot) ([]telego.Message, error) {
+	var media []telego.InputMedia
+	for i, item := range params.Album {
+		fileID, _ := getMessageMediaID(&item)
+		if fileID == nil {
+			continue
+		}
+
+		// The header is only added to the caption of the first item
+		caption, parseMode, entities := item.Caption, "", item.CaptionEntities
+		if i == 0 {
+			caption, parseMode, entities = params.Text, params.ParseMode, params.Entities
+		}
+
+		switch {
+		case item.Photo != nil:
+			media = append(media, tu.MediaPhoto(tu.FileFromID(*fileID)).
+				WithCaption(caption).WithParseMode(parseMode).WithCaptionEntities(entities...))
+		case item.Video != nil:
+			media = append(media, tu.MediaVideo(tu.FileFromID(*fileID)).
+				WithCaption(caption).WithParseMode(parseMode).WithCaptionEntities(entities...))
+		case item.Document != nil:
+			media = append(media, tu.MediaDocument(tu.FileFromID(*fileID)).
+				WithCaption(caption).WithParseMode(parseMode).WithCaptionEntities(entities...))
+		case item.Audio != nil:
+			media = append(media, tu.MediaAudio(tu.FileFromID(*fileID)).
+				WithCaption(caption).WithParseMode(parseMode).WithCaptionEntities(entities...))
+		}
+	}
+
+	if media == nil {
+		return nil, nil
+	}
+
+	return bot.SendMediaGroup(&telego.SendMediaGroupParams{
+		ChatID:          telego.ChatID{ID: id},
+		Media:           media,
+		ReplyParameters: &telego.ReplyParameters{MessageID: params.Reply[id]},
+	})
+}
+
+// Get all items of the album the message belongs to, or nil if the message is not part of an album
+func getAlbum(bot *TBSTBBot, message *telego.Message) []telego.Message {
+	if message.MediaGroupID == "" {
+		return nil
+	}
+
+	return bot.Albums.Get(message.Chat.ID, message.MessageID)
+}
+
+func getMediaGroup(album []telego.Message) []database.Media {
+	var media []database.Media
+	for _, item := range album {
+		fileID, uniqueID := getMessageMediaID(&item)
+		if fileID == nil {
+			continue
+		}
+
+		var caption *string
+		if item.Caption != "" {
+			caption = &item.Caption
+		}
+
+		media = append(media, database.Media{
+			Type:          getMessageMediaType(&item),
+			FileID:        *fileID,
+			UniqueMediaID: *uniqueID,
+			Caption:       caption,
+		})
+	}
+
+	return media
+}
+
+// The sender's own copy of the message, or of every item in the album
+func originReceivers(message *telego.Message, album []telego.Message, userID int64) []database.Receiver {
+	if album == nil {
+		return []database.Receiver{{MSID: message.MessageID, UserID: userID}}
+	}
+
+	var receivers []database.Receiver
+	for _, item := range album {
+		receivers = append(receivers, database.Receiver{MSID: item.MessageID, UserID: userID})
+	}
+
+	return receivers
+}
+
+func noReply(bot *TBSTBBot, original_message int, tickets []database.TicketSummary, user *database.User) {
+	text := "No reply found.\n\n" +
+		"Would you like to create a new ticket with this message " +
+		"or add this message to one of your tickets?\n\n"
+
+	var ticket_options []telego.InlineKeyboardButton
+	if tickets != nil {
+		limit := 3
+		ticket_count := len(tickets)
+		if ticket_count <= 3 {
 			text += fmt.Sprintf("<b>Your tickets 1-%d</b>\n\n", ticket_count)
 			limit = ticket_count
 		} else {
 			text += fmt.Sprintf("<b>Your tickets 1-3 of %d</b>\n\n", ticket_count)
 		}
 
-		for i, id := range ticket_ids[:limit] {
-			text += fmt.Sprintf("<b>%d.</b> <code>%s</code>\n", i+1, id[len(id)-7:])
+		for i, ticket := range tickets[:limit] {
+			id := ticket.ID.Hex()
+			text += formatTicketEntry(i+1, &ticket)
 			ticket_options = append(
 				ticket_options,
 				tu.InlineKeyboardButton(fmt.Sprintf("%d", i+1)).WithCallbackData(fmt.Sprintf("ticket=%s", id)),
@@ -631,7 +1441,7 @@ func noReply(bot *TBSTBBot, original_message int, ticket_ids []string, user *dat
 	})
 }
 
-func newTicket(bot *TBSTBBot, query *telego.CallbackQuery, db *database.Connection) {
+func newTicket(bot *TBSTBBot, query *telego.CallbackQuery, db *database.Connection, config *database.Config) {
 	var query_msg *telego.Message
 	var reply_to *telego.Message
 
@@ -653,6 +1463,9 @@ func newTicket(bot *TBSTBBot, query *telego.CallbackQuery, db *database.Connecti
 		noUser(bot, reply_to)
 		return
 	}
+	if refuseBannedQuery(bot, db, user, query) {
+		return
+	}
 
 	var text string
 	if reply_to.Text != "" {
@@ -662,36 +1475,47 @@ func newTicket(bot *TBSTBBot, query *telego.CallbackQuery, db *database.Connecti
 	}
 
 	media, media_unique := getMessageMediaID(reply_to)
+	album := getAlbum(bot, reply_to)
+	attachment := getMessageAttachment(reply_to)
 
 	id, id_short, ticket := db.CreateTicket(reply_to.From.ID, reply_to.MessageID, &text, media, media_unique)
 
-	var fmtText string
+	ticket.Messages[0].MediaGroup = getMediaGroup(album)
+	ticket.Messages[0].Attachment = attachment
+
+	db.UpdateTicket(id, ticket)
+
+	var header string
 	role, _ := db.GetRole(user.ID)
 	if role != nil {
-		fmtText = formatRoleMessage(text, user, role, id_short)
+		header = formatRoleMessage("", user, role, id_short)
 	} else {
-		fmtText = formatMessage(text, user, id_short)
+		header = formatMessage("", user, id_short)
 	}
 
 	receivers := db.GetRoleReceivers(&user.ID)
 	receivers = append(receivers, db.GetGroupReceivers()...)
 
-	confirmedReceivers := sendMessage(&RelayParams{
-		Text:      fmtText,
-		Media:     media,
-		Users:     receivers,
-		ParseMode: "HTML",
-		Message:   reply_to,
-	}, bot)
-
-	confirmedReceivers = append(confirmedReceivers, database.Receiver{
-		MSID:   reply_to.MessageID,
-		UserID: user.ID,
-	})
+	topics := ensureTopics(bot, db, id, ticket)
 
-	ticket.Messages[0].Receivers = confirmedReceivers
+	fmtText, continuation := formatRelayText(reply_to, header, media != nil)
 
-	db.UpdateTicket(id, ticket)
+	confirmedReceivers := sendMessage(&RelayParams{
+		Text:         fmtText,
+		Media:        media,
+		Users:        receivers,
+		ParseMode:    "HTML",
+		Message:      reply_to,
+		Album:        album,
+		Attachment:   attachment,
+		Continuation: continuation,
+		TicketID:     id,
+	}, bot.InTopics(topics))
+
+	confirmedReceivers = append(confirmedReceivers, originReceivers(reply_to, album, user.ID)...)
+
+	// Receivers are appended rather than replacing the message, so failures recorded while relaying are kept
+	db.AppendReceivers(id, user.ID, reply_to.MessageID, confirmedReceivers)
 
 	bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
 		CallbackQueryID: query.ID,
@@ -705,6 +1529,54 @@ func newTicket(bot *TBSTBBot, query *telego.CallbackQuery, db *database.Connecti
 		ParseMode:   "HTML",
 		ReplyMarkup: nil,
 	})
+
+	if config.PromptTitle {
+		prompt, err := bot.SendMessage(&telego.SendMessageParams{
+			ChatID: telego.ChatID{ID: user.ID},
+			Text: fmt.Sprintf("Reply to this message with a title for ticket <code>%s</code>, or ignore it to keep the current title.\n\n"+
+				"<b>Current title:</b> %s", id_short, formatTitle(ticket.Title)),
+			ReplyMarkup: tu.ForceReply().WithInputFieldPlaceholder("Ticket title").WithSelective(),
+			ParseMode:   "HTML",
+		})
+		if err == nil {
+			db.UpdateTitlePrompt(id, &prompt.MessageID)
+		}
+	}
+}
+
+// If the message is a reply to a title prompt, set the title of the prompted ticket.
+// Returns true if the message was handled as a title.
+func setTitleFromPrompt(bot *TBSTBBot, message *telego.Message, db *database.Connection, user *database.User) bool {
+	id, id_short, ticket := db.GetTicketFromTitlePrompt(message.ReplyToMessage.MessageID, user.ID)
+	if ticket == nil {
+		return false
+	}
+
+	title := database.MakeTitle(message.Text)
+	if title == "" {
+		_, _ = bot.SendMessage(&telego.SendMessageParams{
+			ChatID:          telego.ChatID{ID: user.ID},
+			Text:            "Please send the title as text.",
+			ReplyParameters: &telego.ReplyParameters{MessageID: message.MessageID},
+			ParseMode:       "HTML",
+		})
+		return true
+	}
+
+	ticket.Title = title
+	ticket.TitlePrompt = nil
+
+	db.SetTicketTitle(id, title)
+	renameTopics(bot, db, id_short, ticket)
+
+	_, _ = bot.SendMessage(&telego.SendMessageParams{
+		ChatID:          telego.ChatID{ID: user.ID},
+		Text:            fmt.Sprintf("Ticket <code>%s</code> is now titled %s.", id_short, formatTitle(title)),
+		ReplyParameters: &telego.ReplyParameters{MessageID: message.MessageID},
+		ParseMode:       "HTML",
+	})
+
+	return true
 }
 
 func cancelAddToTicket(bot *TBSTBBot, query *telego.CallbackQuery) {
@@ -755,6 +1627,9 @@ func addToTicket(bot *TBSTBBot, query *telego.CallbackQuery, db *database.Connec
 		noUser(bot, reply_to)
 		return
 	}
+	if refuseBannedQuery(bot, db, user, query) {
+		return
+	}
 
 	ticketID := strings.Split(query.Data, "=")[1]
 
@@ -782,13 +1657,15 @@ func addToTicket(bot *TBSTBBot, query *telego.CallbackQuery, db *database.Connec
 	}
 
 	media, media_unique := getMessageMediaID(reply_to)
+	album := getAlbum(bot, reply_to)
+	attachment := getMessageAttachment(reply_to)
 
-	var fmtText string
+	var header string
 	role, _ := db.GetRole(user.ID)
 	if role != nil {
-		fmtText = formatRoleMessage(text, user, role, ticketID[len(ticketID)-7:])
+		header = formatRoleMessage("", user, role, ticketID[len(ticketID)-7:])
 	} else {
-		fmtText = formatMessage(text, user, ticketID[len(ticketID)-7:])
+		header = formatMessage("", user, ticketID[len(ticketID)-7:])
 	}
 
 	var receivers []int64
@@ -798,29 +1675,38 @@ func addToTicket(bot *TBSTBBot, query *telego.CallbackQuery, db *database.Connec
 		receivers = db.GetRoleReceivers(&user.ID)
 	}
 
-	confirmedReceivers := sendMessage(&RelayParams{
-		Text:      fmtText,
-		Media:     media,
-		Users:     receivers,
-		ParseMode: "HTML",
-		Message:   reply_to,
-	}, bot)
-
-	confirmedReceivers = append(confirmedReceivers, database.Receiver{
-		MSID:   reply_to.MessageID,
-		UserID: user.ID,
-	})
+	topics := ensureTopics(bot, db, ticketID, ticket)
+	receivers = withTopics(receivers, topics, reply_to.Chat.ID)
 
+	// Store the message before relaying it, so failures recorded while relaying have a message to be added to
 	db.AppendMessage(ticketID, &database.Message{
 		Sender:        user.ID,
-		OriginMSID:    query_msg.MessageID,
+		OriginMSID:    reply_to.MessageID,
 		DateSent:      time.Now(),
-		Receivers:     confirmedReceivers,
+		Receivers:     originReceivers(reply_to, album, user.ID),
 		Text:          &text,
 		Media:         media,
 		UniqueMediaID: media_unique,
+		MediaGroup:    getMediaGroup(album),
+		Attachment:    attachment,
 	})
 
+	fmtText, continuation := formatRelayText(reply_to, header, media != nil)
+
+	confirmedReceivers := sendMessage(&RelayParams{
+		Text:         fmtText,
+		Media:        media,
+		Users:        receivers,
+		ParseMode:    "HTML",
+		Message:      reply_to,
+		Album:        album,
+		Attachment:   attachment,
+		Continuation: continuation,
+		TicketID:     ticketID,
+	}, bot.InTopics(topics))
+
+	db.AppendReceivers(ticketID, user.ID, reply_to.MessageID, confirmedReceivers)
+
 	bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
 		CallbackQueryID: query.ID,
 		Text:            fmt.Sprintf("Added message to ticket %s", ticketID[len(ticketID)-7:]),
@@ -835,98 +1721,6 @@ func addToTicket(bot *TBSTBBot, query *telego.CallbackQuery, db *database.Connec
 	})
 }
 
-func broadcastCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection) {
-	role, err := db.GetRole(update.Message.From.ID)
-	if err != nil {
-		noUser(bot, update.Message)
-		return
-	}
-	if role.RoleType != "owner" {
-		return
-	}
-
-	var text string
-	if update.Message.Caption == "" {
-		text = update.Message.Text
-	} else {
-		text = update.Message.Caption
-	}
-
-	var chatID int64
-	if update.Message.Chat.Type == "group" || update.Message.Chat.Type == "supergroup" {
-		chatID = update.Message.Chat.ID
-	} else {
-		chatID = role.ID
-	}
-
-	arg := strings.SplitN(text, " ", 2)
-	if len(arg) != 2 {
-		if update.Message.Caption != "" {
-			text = ""
-		} else {
-			_, _ = bot.SendMessage(&telego.SendMessageParams{
-				ChatID:          telego.ChatID{ID: chatID},
-				Text:            "The broadcast command requires input.",
-				ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
-				ParseMode:       "HTML",
-			})
-
-			return
-		}
-	} else {
-		text = arg[1]
-	}
-
-	if strings.TrimSpace(text) != text {
-		_, _ = bot.SendMessage(&telego.SendMessageParams{
-			ChatID:          telego.ChatID{ID: chatID},
-			Text:            "Please remove any whitespaces between the command and the text.",
-			ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
-			ParseMode:       "HTML",
-		})
-
-		return
-	}
-
-	users := db.GetBroadcastableUsers(&chatID)
-	if users == nil {
-		return
-	}
-
-	var updatedEntities []telego.MessageEntity
-	if len(update.Message.Entities) > 1 {
-		updatedEntities = update.Message.Entities[1:]
-		offset := update.Message.Entities[0].Length + 1
-		for i := range updatedEntities {
-			updatedEntities[i].Offset -= offset
-		}
-	} else if len(update.Message.CaptionEntities) > 1 {
-		updatedEntities = update.Message.CaptionEntities[1:]
-		offset := update.Message.CaptionEntities[0].Length + 1
-		for i := range updatedEntities {
-			updatedEntities[i].Offset -= offset
-		}
-	}
-
-	message_media, _ := getMessageMediaID(update.Message)
-
-	confirmedReceivers := sendMessage(&RelayParams{
-		Text:     text,
-		Media:    message_media,
-		Entities: updatedEntities,
-		Users:    *users,
-		Message:  update.Message,
-	}, bot)
-
-	count := len(confirmedReceivers)
-
-	_, _ = bot.SendMessage(&telego.SendMessageParams{
-		ChatID:          telego.ChatID{ID: chatID},
-		Text:            fmt.Sprintf("Success! Sent broadcast to %d users.", count),
-		ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
-	})
-}
-
 func versionCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection) {
 	if update.Message.Chat.Type == "group" || update.Message.Chat.Type == "supergroup" {
 		return
@@ -977,6 +1771,20 @@ This information is updated with every USER message processed by the SOFTWARE.
 <i>USER message content</i>
 The message ID of a USER's message is stored for future processing. This message ID is tied to the USER's Telegram provided unique user ID.
 The message media id, unique media ID, sent day, and/or text/caption will be stored for future processing.
+Shared locations, venues, contacts, polls, dice, and stories will be stored with their content for future processing.
+If the USER edits a message, the previous text/caption and the date of the edit will also be stored.
+If a message is deleted from a ticket, its stored content is retained as an audit record.
+
+<i>Broadcast delivery</i>
+When the USER receives a broadcast, the message ID of the USER's copy is stored so that it can later be edited or deleted.
+If a broadcast cannot be delivered to the USER, the reason given by Telegram is stored.
+
+<i>USER settings</i>
+The preferences the USER chooses with /settings, such as anonymous mode and preferred language, are stored.
+The preferred language is shown to staff with the USER's ticket messages.
+
+<i>Moderation</i>
+If the USER is banned, the reason given by staff and the date the ban ends are stored.
 
 <b><u>How USER data is collected and used:</u></b>
 
@@ -1031,12 +1839,8 @@ func closeCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection)
 		noUser(bot, update.Message)
 		return
 	}
-	role, err := db.GetRole(update.Message.From.ID)
-	if err != nil {
-		return
-	}
-
-	if !(role.RoleType == "owner" || role.RoleType == "admin") {
+	role, allowed := authorize(db, update.Message.From.ID, database.PermissionClose)
+	if !allowed {
 		return
 	}
 
@@ -1047,7 +1851,11 @@ func closeCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection)
 		chatID = role.ID
 	}
 
-	id, id_short, ticket := db.GetTicketFromMSID(reply_to.MessageID, role.ID)
+	// In a topic, the command applies to the topic's ticket, whichever message it replies to
+	id, id_short, ticket := commandTicket(db, update.Message)
+	if ticket == nil {
+		id, id_short, ticket = db.GetTicketFromMSID(reply_to.MessageID, chatID)
+	}
 	if ticket == nil {
 		_, _ = bot.SendMessage(&telego.SendMessageParams{
 			ChatID:          telego.ChatID{ID: chatID},
@@ -1063,7 +1871,7 @@ func closeCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection)
 	closed_time := time.Now()
 	ticket.DateClosed = &closed_time
 
-	db.UpdateTicket(id, ticket)
+	db.SetTicketClosed(id, ticket.ClosedBy, ticket.DateClosed)
 
 	text := fmt.Sprintf("Ticket <code>%s</code> has been closed.", id_short)
 
@@ -1073,6 +1881,10 @@ func closeCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection)
 	} else {
 		receivers = db.GetOriginReceivers(&role.ID, ticket.Creator)
 	}
+	receivers = withoutOptedOut(receivers, ticket.Creator, db)
+
+	topics := ticketTopics(db, ticket)
+	receivers = withTopics(receivers, topics, chatID)
 
 	sendMessage(&RelayParams{
 		Text:      text,
@@ -1081,7 +1893,9 @@ func closeCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection)
 		Reply:     nil,
 		ParseMode: "HTML",
 		Message:   update.Message,
-	}, bot)
+	}, bot.InTopics(topics))
+
+	closeTopics(bot, db, ticket, true)
 }
 
 func reopenCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection) {
@@ -1100,10 +1914,29 @@ func reopenCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection
 		noUser(bot, update.Message)
 		return
 	}
+	if refuseBanned(bot, db, user, update.Message) {
+		return
+	}
 
-	// if user.CanReopen == false {
-	// 	return
-	// }
+	// Staff need permission to reopen tickets; users need to be allowed to reopen their own
+	role, allowed := authorize(db, user.ID, database.PermissionReopen)
+	if role != nil && !allowed {
+		return
+	}
+	// Read the config again, so changes to the defaults apply without a restart
+	config, err := db.GetConfig()
+	if err != nil {
+		return
+	}
+	if role == nil && !user.MayReopen(config) {
+		_, _ = bot.SendMessage(&telego.SendMessageParams{
+			ChatID:          telego.ChatID{ID: user.ID},
+			Text:            "You are not allowed to reopen tickets. Please create a new ticket instead.",
+			ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+			ParseMode:       "HTML",
+		})
+		return
+	}
 
 	var chatID int64
 	if update.Message.Chat.Type == "group" || update.Message.Chat.Type == "supergroup" {
@@ -1112,10 +1945,18 @@ func reopenCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection
 		chatID = user.ID
 	}
 
-	id, id_short, ticket := db.GetTicketFromMSID(reply_to.MessageID, user.ID)
+	// Only staff reopen tickets from their topics; users can only reopen tickets they created
+	var id, id_short string
+	var ticket *database.Ticket
+	if role != nil {
+		id, id_short, ticket = commandTicket(db, update.Message)
+	}
 	if ticket == nil {
+		id, id_short, ticket = db.GetTicketFromMSID(reply_to.MessageID, chatID)
+	}
+	if ticket == nil || (role == nil && ticket.Creator != user.ID) {
 		_, _ = bot.SendMessage(&telego.SendMessageParams{
-			ChatID:          telego.ChatID{ID: user.ID},
+			ChatID:          telego.ChatID{ID: chatID},
 			Text:            "This ticket or message does not exist.",
 			ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
 			ParseMode:       "HTML",
@@ -1123,16 +1964,38 @@ func reopenCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection
 		return
 	}
 
+	if ticket.DateClosed == nil {
+		_, _ = bot.SendMessage(&telego.SendMessageParams{
+			ChatID:          telego.ChatID{ID: chatID},
+			Text:            fmt.Sprintf("Ticket <code>%s</code> is already open.", id_short),
+			ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+			ParseMode:       "HTML",
+		})
+		return
+	}
+
+	window := config.GetReopenWindow()
+	if role == nil && window > 0 && time.Since(*ticket.DateClosed) > time.Duration(window)*24*time.Hour {
+		_, _ = bot.SendMessage(&telego.SendMessageParams{
+			ChatID: telego.ChatID{ID: user.ID},
+			Text: fmt.Sprintf("Tickets can only be reopened within %d days of being closed. Please create a new ticket instead.",
+				window),
+			ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+			ParseMode:       "HTML",
+		})
+		return
+	}
+
 	ticket.ClosedBy = nil
 	ticket.DateClosed = nil
 
-	db.UpdateTicket(id, ticket)
+	db.SetTicketClosed(id, ticket.ClosedBy, ticket.DateClosed)
 
 	var text string
 	if user.Onymity {
 		text = fmt.Sprintf("Ticket <code>%s</code> has been reopenned by Anon.", id_short)
 	} else {
-		text = fmt.Sprintf("Ticket <code>%s</code> has been reopenned by %s.", id_short, user.Fullname)
+		text = fmt.Sprintf("Ticket <code>%s</code> has been reopenned by %s.", id_short, html.EscapeString(user.Fullname))
 	}
 
 	var receivers []int64
@@ -1141,6 +2004,14 @@ func reopenCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection
 	} else {
 		receivers = db.GetOriginReceivers(&user.ID, ticket.Creator)
 	}
+	if ticket.Creator != user.ID {
+		receivers = withoutOptedOut(receivers, ticket.Creator, db)
+	}
+
+	closeTopics(bot, db, ticket, false)
+
+	topics := ticketTopics(db, ticket)
+	receivers = withTopics(receivers, topics, chatID)
 
 	sendMessage(&RelayParams{
 		Text:      text,
@@ -1149,12 +2020,15 @@ func reopenCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection
 		Reply:     nil,
 		ParseMode: "HTML",
 		Message:   update.Message,
-	}, bot)
+	}, bot.InTopics(topics))
 }
 
-func assignCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection) {
+func titleCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection) {
 	reply_to := update.Message.ReplyToMessage
 	if reply_to == nil {
+		if update.Message.Chat.Type == "group" || update.Message.Chat.Type == "supergroup" {
+			return
+		}
 		_, _ = bot.SendMessage(&telego.SendMessageParams{
 			ChatID:          telego.ChatID{ID: update.Message.From.ID},
 			Text:            "Please reply to a message to use this command.",
@@ -1163,17 +2037,265 @@ func assignCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection
 		})
 		return
 	}
-	_, err := db.GetUser(update.Message.From.ID)
+	user, err := db.GetUser(update.Message.From.ID)
 	if err != nil {
 		noUser(bot, update.Message)
 		return
 	}
-	role, err := db.GetRole(update.Message.From.ID)
+	if refuseBanned(bot, db, user, update.Message) {
+		return
+	}
+
+	var chatID int64
+	if update.Message.Chat.Type == "group" || update.Message.Chat.Type == "supergroup" {
+		chatID = update.Message.Chat.ID
+	} else {
+		chatID = user.ID
+	}
+
+	id, id_short, ticket := db.GetTicketFromMSID(reply_to.MessageID, chatID)
+	if ticket == nil {
+		id, id_short, ticket = commandTicket(db, update.Message)
+	}
+	if ticket == nil {
+		_, _ = bot.SendMessage(&telego.SendMessageParams{
+			ChatID:          telego.ChatID{ID: chatID},
+			Text:            "This ticket or message does not exist.",
+			ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+			ParseMode:       "HTML",
+		})
+		return
+	}
+
+	// Users can title their own tickets; staff need permission to edit tickets
+	role, allowed := authorize(db, user.ID, database.PermissionEditTickets)
+	if (role == nil && ticket.Creator != user.ID) || (role != nil && !allowed) {
+		return
+	}
+
+	arg := strings.SplitN(update.Message.Text, " ", 2)
+	var title string
+	if len(arg) == 2 {
+		title = database.MakeTitle(arg[1])
+	}
+
+	if title == "" {
+		_, _ = bot.SendMessage(&telego.SendMessageParams{
+			ChatID:          telego.ChatID{ID: chatID},
+			Text:            fmt.Sprintf("The current title of ticket <code>%s</code> is %s.\nUse /title followed by text to change it.", id_short, formatTitle(ticket.Title)),
+			ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+			ParseMode:       "HTML",
+		})
+		return
+	}
+
+	ticket.Title = title
+	ticket.TitlePrompt = nil
+
+	db.SetTicketTitle(id, title)
+	renameTopics(bot, db, id_short, ticket)
+
+	_, _ = bot.SendMessage(&telego.SendMessageParams{
+		ChatID:          telego.ChatID{ID: chatID},
+		Text:            fmt.Sprintf("Ticket <code>%s</code> is now titled %s.", id_short, formatTitle(title)),
+		ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+		ParseMode:       "HTML",
+	})
+}
+
+// Staff file tickets under a category, which broadcasts can be targeted at
+func categoryCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection) {
+	reply_to := update.Message.ReplyToMessage
+	if reply_to == nil {
+		if update.Message.Chat.Type == "group" || update.Message.Chat.Type == "supergroup" {
+			return
+		}
+		_, _ = bot.SendMessage(&telego.SendMessageParams{
+			ChatID:          telego.ChatID{ID: update.Message.From.ID},
+			Text:            "Please reply to a message to use this command.",
+			ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+			ParseMode:       "HTML",
+		})
+		return
+	}
+	role, allowed := authorize(db, update.Message.From.ID, database.PermissionEditTickets)
+	if !allowed {
+		return
+	}
+
+	var chatID int64
+	if update.Message.Chat.Type == "group" || update.Message.Chat.Type == "supergroup" {
+		chatID = update.Message.Chat.ID
+	} else {
+		chatID = role.ID
+	}
+
+	id, id_short, ticket := db.GetTicketFromMSID(reply_to.MessageID, chatID)
+	if ticket == nil {
+		id, id_short, ticket = commandTicket(db, update.Message)
+	}
+	if ticket == nil {
+		_, _ = bot.SendMessage(&telego.SendMessageParams{
+			ChatID:          telego.ChatID{ID: chatID},
+			Text:            "This ticket or message does not exist.",
+			ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+			ParseMode:       "HTML",
+		})
+		return
+	}
+
+	arg := strings.Fields(update.Message.Text)
+	if len(arg) < 2 {
+		current := "<i>Uncategorized</i>"
+		if ticket.Category != "" {
+			current = fmt.Sprintf("<b>%s</b>", html.EscapeString(ticket.Category))
+		}
+
+		_, _ = bot.SendMessage(&telego.SendMessageParams{
+			ChatID: telego.ChatID{ID: chatID},
+			Text: fmt.Sprintf("The category of ticket <code>%s</code> is %s.\n"+
+				"Use /category followed by a single word to change it, or <code>/category none</code> to remove it.", id_short, current),
+			ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+			ParseMode:       "HTML",
+		})
+		return
+	}
+	if len(arg) > 2 {
+		_, _ = bot.SendMessage(&telego.SendMessageParams{
+			ChatID:          telego.ChatID{ID: chatID},
+			Text:            "A category must be a single word.",
+			ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+			ParseMode:       "HTML",
+		})
+		return
+	}
+
+	ticket.Category = strings.ToLower(arg[1])
+	if ticket.Category == "none" {
+		ticket.Category = ""
+	}
+
+	db.SetTicketCategory(id, ticket.Category)
+
+	text := fmt.Sprintf("Ticket <code>%s</code> is now in the <b>%s</b> category.", id_short, html.EscapeString(ticket.Category))
+	if ticket.Category == "" {
+		text = fmt.Sprintf("Ticket <code>%s</code> is no longer categorized.", id_short)
+	}
+
+	_, _ = bot.SendMessage(&telego.SendMessageParams{
+		ChatID:          telego.ChatID{ID: chatID},
+		Text:            text,
+		ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+		ParseMode:       "HTML",
+	})
+}
+
+func deleteCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection) {
+	// Senders can only delete their own messages within this window
+	const delete_window = 24 * time.Hour
+
+	reply_to := update.Message.ReplyToMessage
+	if reply_to == nil {
+		if update.Message.Chat.Type == "group" || update.Message.Chat.Type == "supergroup" {
+			return
+		}
+		_, _ = bot.SendMessage(&telego.SendMessageParams{
+			ChatID:          telego.ChatID{ID: update.Message.From.ID},
+			Text:            "Please reply to a message to use this command.",
+			ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+			ParseMode:       "HTML",
+		})
+		return
+	}
+	user, err := db.GetUser(update.Message.From.ID)
 	if err != nil {
+		noUser(bot, update.Message)
+		return
+	}
+	if refuseBanned(bot, db, user, update.Message) {
 		return
 	}
 
-	if !(role.RoleType == "owner" || role.RoleType == "admin") {
+	var chatID int64
+	if update.Message.Chat.Type == "group" || update.Message.Chat.Type == "supergroup" {
+		chatID = update.Message.Chat.ID
+	} else {
+		chatID = user.ID
+	}
+
+	id, _, message := db.GetTicketAndMessage(reply_to.MessageID, chatID)
+	if message == nil || message.DeletedBy != nil {
+		_, _ = bot.SendMessage(&telego.SendMessageParams{
+			ChatID:          telego.ChatID{ID: chatID},
+			Text:            "This ticket or message does not exist.",
+			ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+			ParseMode:       "HTML",
+		})
+		return
+	}
+
+	if _, allowed := authorize(db, user.ID, database.PermissionDeleteMessages); !allowed {
+		if message.Sender != user.ID {
+			_, _ = bot.SendMessage(&telego.SendMessageParams{
+				ChatID:          telego.ChatID{ID: chatID},
+				Text:            "You can only delete your own messages.",
+				ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+				ParseMode:       "HTML",
+			})
+			return
+		}
+		if time.Since(message.DateSent) > delete_window {
+			_, _ = bot.SendMessage(&telego.SendMessageParams{
+				ChatID:          telego.ChatID{ID: chatID},
+				Text:            "This message is too old to be deleted.",
+				ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+				ParseMode:       "HTML",
+			})
+			return
+		}
+	}
+
+	count := 0
+	for _, receiver := range message.Receivers {
+		err := bot.DeleteMessage(&telego.DeleteMessageParams{
+			ChatID:    telego.ChatID{ID: receiver.UserID},
+			MessageID: receiver.MSID,
+		})
+		if err != nil {
+			fmt.Printf("%s\n", err)
+			continue
+		}
+		count++
+	}
+
+	db.DeleteMessage(id, message, user.ID)
+
+	_, _ = bot.SendMessage(&telego.SendMessageParams{
+		ChatID:          telego.ChatID{ID: chatID},
+		Text:            fmt.Sprintf("Deleted %d copies of the message from ticket <code>%s</code>.", count, id[len(id)-7:]),
+		ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+		ParseMode:       "HTML",
+	})
+}
+
+func assignCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection) {
+	reply_to := update.Message.ReplyToMessage
+	if reply_to == nil {
+		_, _ = bot.SendMessage(&telego.SendMessageParams{
+			ChatID:          telego.ChatID{ID: update.Message.From.ID},
+			Text:            "Please reply to a message to use this command.",
+			ReplyParameters: &telego.ReplyParameters{MessageID: update.Message.MessageID},
+			ParseMode:       "HTML",
+		})
+		return
+	}
+	_, err := db.GetUser(update.Message.From.ID)
+	if err != nil {
+		noUser(bot, update.Message)
+		return
+	}
+	role, allowed := authorize(db, update.Message.From.ID, database.PermissionAssign)
+	if !allowed {
 		return
 	}
 
@@ -1200,8 +2322,7 @@ func assignCommand(bot *TBSTBBot, update *telego.Update, db *database.Connection
 		}
 
 		for i, role := range roles[:limit] {
-			// TODO: Add check for groups; use an anonymous identifier then
-			text += fmt.Sprintf("<b>%d.</b> %s\n", i+1, role.Name)
+			text += fmt.Sprintf("<b>%d.</b> %s\n", i+1, html.EscapeString(staffName(&role)))
 
 			role_options = append(
 				role_options,
@@ -1264,8 +2385,8 @@ func assignToTicket(bot *TBSTBBot, query *telego.CallbackQuery, db *database.Con
 		return
 	}
 
-	role, err := db.GetRole(reply_to.From.ID)
-	if err != nil {
+	role, allowed := authorize(db, reply_to.From.ID, database.PermissionAssign)
+	if !allowed {
 		return
 	}
 
@@ -1289,7 +2410,9 @@ func assignToTicket(bot *TBSTBBot, query *telego.CallbackQuery, db *database.Con
 		return
 	}
 
-	if assignee.RoleType == "owner" && role.RoleType == "admin" {
+	// Staff cannot assign tickets to those who outrank them
+	ranks, err := db.GetConfig()
+	if err != nil || ranks.GetRank(assignee.RoleType) > ranks.GetRank(role.RoleType) {
 		return
 	}
 
@@ -1306,17 +2429,17 @@ func assignToTicket(bot *TBSTBBot, query *telego.CallbackQuery, db *database.Con
 
 	ticket.Assignees = append(ticket.Assignees, int64(userID))
 
-	db.UpdateTicket(id, ticket)
+	db.SetTicketAssignees(id, ticket.Assignees)
 
 	bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
 		CallbackQueryID: query.ID,
-		Text:            fmt.Sprintf("Assigned %s to ticket %s", assignee.Name, id_short),
+		Text:            fmt.Sprintf("Assigned %s to ticket %s", staffName(assignee), id_short),
 	})
 
 	bot.EditMessageText(&telego.EditMessageTextParams{
 		ChatID:      telego.ChatID{ID: query.From.ID},
 		MessageID:   query_msg.MessageID,
-		Text:        fmt.Sprintf("Assigned %s to ticket <code>%s</code>.", assignee.Name, id_short),
+		Text:        fmt.Sprintf("Assigned %s to ticket <code>%s</code>.", html.EscapeString(staffName(assignee)), id_short),
 		ParseMode:   "HTML",
 		ReplyMarkup: nil,
 	})
@@ -1378,6 +2501,55 @@ func getMessageMediaID(message *telego.Message) (*string, *string) {
 	return nil, nil
 }
 
+// Get the file size and file name of the media in a message, if known
+func getMessageMediaInfo(message *telego.Message) (int64, string) {
+	switch {
+	case message.Animation != nil:
+		return message.Animation.FileSize, message.Animation.FileName
+	case message.Document != nil:
+		return message.Document.FileSize, message.Document.FileName
+	case message.Sticker != nil:
+		return int64(message.Sticker.FileSize), ""
+	case message.Video != nil:
+		return message.Video.FileSize, message.Video.FileName
+	case message.VideoNote != nil:
+		return int64(message.VideoNote.FileSize), ""
+	case message.Audio != nil:
+		return message.Audio.FileSize, message.Audio.FileName
+	case message.Photo != nil:
+		var size int64
+		for _, photo := range message.Photo {
+			size = max(size, int64(photo.FileSize))
+		}
+		return size, ""
+	case message.Voice != nil:
+		return message.Voice.FileSize, ""
+	}
+	return 0, ""
+}
+
+func getMessageMediaType(message *telego.Message) string {
+	switch {
+	case message.Animation != nil:
+		return "animation"
+	case message.Document != nil:
+		return "document"
+	case message.Sticker != nil:
+		return "sticker"
+	case message.Video != nil:
+		return "video"
+	case message.VideoNote != nil:
+		return "video_note"
+	case message.Audio != nil:
+		return "audio"
+	case message.Photo != nil:
+		return "photo"
+	case message.Voice != nil:
+		return "voice"
+	}
+	return ""
+}
+
 func nextPage(bot *TBSTBBot, query *telego.CallbackQuery, db *database.Connection) {
 	const page_size = 3
 
@@ -1403,7 +2575,7 @@ func nextPage(bot *TBSTBBot, query *telego.CallbackQuery, db *database.Connectio
 		return
 	}
 
-	tickets := db.GetTicketIDs(query.From.ID)
+	tickets := db.GetTicketSummaries(query.From.ID)
 
 	ticket_page := paginate(page_number, page_size, tickets)
 
@@ -1424,8 +2596,9 @@ func nextPage(bot *TBSTBBot, query *telego.CallbackQuery, db *database.Connectio
 		tu.InlineKeyboardButton("⬅️").WithCallbackData(fmt.Sprintf("prev_page=%d", page_number-1)),
 	)
 
-	for i, id := range ticket_page {
-		text += fmt.Sprintf("<b>%d.</b> <code>%s</code>\n", i+1, id[len(id)-7:])
+	for i, ticket := range ticket_page {
+		id := ticket.ID.Hex()
+		text += formatTicketEntry(i+1, &ticket)
 		ticket_options = append(
 			ticket_options,
 			tu.InlineKeyboardButton(fmt.Sprintf("%d", i+1)).WithCallbackData(fmt.Sprintf("ticket=%s", id)),
@@ -1485,7 +2658,7 @@ func prevPage(bot *TBSTBBot, query *telego.CallbackQuery, db *database.Connectio
 		return
 	}
 
-	tickets := db.GetTicketIDs(query.From.ID)
+	tickets := db.GetTicketSummaries(query.From.ID)
 
 	ticket_page := paginate(page_number, page_size, tickets)
 
@@ -1504,8 +2677,9 @@ func prevPage(bot *TBSTBBot, query *telego.CallbackQuery, db *database.Connectio
 		)
 	}
 
-	for i, id := range ticket_page {
-		text += fmt.Sprintf("<b>%d.</b> <code>%s</code>\n", i+1, id[len(id)-7:])
+	for i, ticket := range ticket_page {
+		id := ticket.ID.Hex()
+		text += formatTicketEntry(i+1, &ticket)
 		ticket_options = append(
 			ticket_options,
 			tu.InlineKeyboardButton(fmt.Sprintf("%d", i+1)).WithCallbackData(fmt.Sprintf("ticket=%s", id)),
@@ -1586,8 +2760,7 @@ func nextAssignPage(bot *TBSTBBot, query *telego.CallbackQuery, db *database.Con
 	)
 
 	for i, role := range roles_page {
-		// TODO: Add check for groups; use an anonymous identifier then
-		text += fmt.Sprintf("<b>%d.</b> %s\n", i+1, role.Name)
+		text += fmt.Sprintf("<b>%d.</b> %s\n", i+1, html.EscapeString(staffName(&role)))
 
 		role_options = append(
 			role_options,
@@ -1670,8 +2843,7 @@ func prevAssignPage(bot *TBSTBBot, query *telego.CallbackQuery, db *database.Con
 	}
 
 	for i, role := range roles_page {
-		// TODO: Add check for groups; use an anonymous identifier then
-		text += fmt.Sprintf("<b>%d.</b> %s\n", i+1, role.Name)
+		text += fmt.Sprintf("<b>%d.</b> %s\n", i+1, html.EscapeString(staffName(&role)))
 
 		role_options = append(
 			role_options,
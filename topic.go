@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	database "github.com/Charibdys/tbstb/database"
+
+	"github.com/mymmrac/telego"
+)
+
+const (
+	// How long to remember whether a group is a forum
+	forumCheckInterval = 10 * time.Minute
+	// Telegram allows topic names of up to 128 characters
+	maxTopicName = 128
+)
+
+type forumStatus struct {
+	forum   bool
+	checked time.Time
+}
+
+// Topics remembers which staff groups are forums, where each ticket gets a topic of its own
+type Topics struct {
+	mu     sync.Mutex
+	forums map[int64]forumStatus
+}
+
+func NewTopics() *Topics {
+	return &Topics{
+		forums: make(map[int64]forumStatus),
+	}
+}
+
+// Check whether the group is a forum in which ticket topics can be created
+func (t *Topics) IsForum(bot *TBSTBBot, chatID int64) bool {
+	t.mu.Lock()
+	status, ok := t.forums[chatID]
+	t.mu.Unlock()
+
+	if ok && time.Since(status.checked) < forumCheckInterval {
+		return status.forum
+	}
+
+	chat, err := bot.GetChat(&telego.GetChatParams{ChatID: telego.ChatID{ID: chatID}})
+	forum := err == nil && chat.IsForum
+
+	t.set(chatID, forum)
+
+	return forum
+}
+
+func (t *Topics) set(chatID int64, forum bool) {
+	t.mu.Lock()
+	t.forums[chatID] = forumStatus{forum: forum, checked: time.Now()}
+	t.mu.Unlock()
+}
+
+// InTopics returns a copy of the bot that sends messages for groups into the given topics
+func (bot *TBSTBBot) InTopics(topics map[int64]int) *TBSTBBot {
+	routed := *bot
+	routed.topics = topics
+
+	return &routed
+}
+
+// Get the topic to send to in the chat, unless one was already chosen
+func (bot *TBSTBBot) thread(chatID telego.ChatID, thread int) int {
+	if thread != 0 {
+		return thread
+	}
+
+	return bot.topics[chatID.ID]
+}
+
+func topicName(id_short string, title string) string {
+	if title == "" {
+		title = "Untitled"
+	}
+
+	name := []rune(fmt.Sprintf("%s %s", id_short, title))
+	if len(name) > maxTopicName {
+		name = name[:maxTopicName]
+	}
+
+	return string(name)
+}
+
+// Get the topics of a ticket by the ID of their group, leaving out groups that are no longer registered
+func ticketTopics(db *database.Connection, ticket *database.Ticket) map[int64]int {
+	groups := db.GetGroupReceivers()
+
+	topics := make(map[int64]int)
+	for _, topic := range ticket.Topics {
+		if slices.Contains(groups, topic.ChatID) {
+			topics[topic.ChatID] = topic.ThreadID
+		}
+	}
+
+	return topics
+}
+
+// Create a topic for the ticket in every registered forum group that does not have one yet.
+// Returns the topics of the ticket by the ID of their group.
+func ensureTopics(bot *TBSTBBot, db *database.Connection, id string, ticket *database.Ticket) map[int64]int {
+	topics := ticketTopics(db, ticket)
+
+	for _, group := range db.GetGroupReceivers() {
+		if _, ok := topics[group]; ok || !bot.Topics.IsForum(bot, group) {
+			continue
+		}
+
+		topic, err := bot.CreateForumTopic(&telego.CreateForumTopicParams{
+			ChatID: telego.ChatID{ID: group},
+			Name:   topicName(id[len(id)-7:], ticket.Title),
+		})
+		if err != nil {
+			// Most likely the bot is not allowed to manage topics; use the group as usual until it is checked again
+			fmt.Printf("%s\n", err)
+			bot.Topics.set(group, false)
+			continue
+		}
+
+		if !db.AppendTopic(id, &database.Topic{ChatID: group, ThreadID: topic.MessageThreadID}) {
+			// Another message created a topic for the ticket first; use that one instead
+			_ = bot.DeleteForumTopic(&telego.DeleteForumTopicParams{
+				ChatID:          telego.ChatID{ID: group},
+				MessageThreadID: topic.MessageThreadID,
+			})
+
+			if current, err := db.GetTicket(id); err == nil {
+				for _, existing := range current.Topics {
+					if existing.ChatID == group {
+						topics[group] = existing.ThreadID
+					}
+				}
+			}
+			continue
+		}
+
+		topics[group] = topic.MessageThreadID
+	}
+
+	return topics
+}
+
+// Add the groups the ticket has topics in to the receivers, except for the chat the message came from
+func withTopics(receivers []int64, topics map[int64]int, origin int64) []int64 {
+	for group := range topics {
+		if group != origin && !slices.Contains(receivers, group) {
+			receivers = append(receivers, group)
+		}
+	}
+
+	return receivers
+}
+
+func renameTopics(bot *TBSTBBot, db *database.Connection, id_short string, ticket *database.Ticket) {
+	for group, thread := range ticketTopics(db, ticket) {
+		_ = bot.EditForumTopic(&telego.EditForumTopicParams{
+			ChatID:          telego.ChatID{ID: group},
+			MessageThreadID: thread,
+			Name:            topicName(id_short, ticket.Title),
+		})
+	}
+}
+
+// Close the topics of a closed ticket, or reopen them along with the ticket
+func closeTopics(bot *TBSTBBot, db *database.Connection, ticket *database.Ticket, closed bool) {
+	for group, thread := range ticketTopics(db, ticket) {
+		if closed {
+			_ = bot.CloseForumTopic(&telego.CloseForumTopicParams{
+				ChatID:          telego.ChatID{ID: group},
+				MessageThreadID: thread,
+			})
+		} else {
+			_ = bot.ReopenForumTopic(&telego.ReopenForumTopicParams{
+				ChatID:          telego.ChatID{ID: group},
+				MessageThreadID: thread,
+			})
+		}
+	}
+}
+
+// Get the ticket of the topic a command was sent in, for when it does not reply to a relayed message
+func commandTicket(db *database.Connection, message *telego.Message) (string, string, *database.Ticket) {
+	if !message.IsTopicMessage {
+		return "", "", nil
+	}
+
+	return db.GetTicketFromTopic(message.Chat.ID, message.MessageThreadID)
+}